@@ -2,33 +2,59 @@ package main
 
 import (
     "context"
+    "fmt"
     "log"
     "net/http"
     "os"
     "os/signal"
+    "path/filepath"
     "syscall"
     "time"
+    _ "time/tzdata" // TIMEZONE must work in images without tzdata
 
     "github.com/joho/godotenv"
 
     "karting-bot/internal/config"
     "karting-bot/internal/payments"
+    "karting-bot/internal/scheduler"
     "karting-bot/internal/server"
     "karting-bot/internal/sheets"
+    "karting-bot/internal/store"
+    "karting-bot/internal/store/file"
+    "karting-bot/internal/store/memory"
     "karting-bot/internal/tgbot"
 )
 
 func main() {
     _ = godotenv.Load()
 
+    // the maintenance commands only need the storage settings
+    if len(os.Args) > 1 && (os.Args[1] == "migrate" || os.Args[1] == "repair-teams") {
+        cfg, err := config.StorageFromEnv()
+        if err != nil {
+            log.Fatalf("config: %v", err)
+        }
+        if os.Args[1] == "migrate" {
+            if err := migrate(cfg); err != nil {
+                log.Fatalf("migrate: %v", err)
+            }
+            log.Printf("migrate: schema is at version %d", sheets.SchemaVersion())
+            return
+        }
+        if err := repairTeams(cfg); err != nil {
+            log.Fatalf("repair-teams: %v", err)
+        }
+        return
+    }
+
     cfg, err := config.FromEnv()
     if err != nil {
         log.Fatalf("config: %v", err)
     }
 
-    sheetsClient, err := sheets.New(cfg.GoogleServiceAccountJSON, cfg.SpreadsheetID)
+    db, err := openStore(cfg)
     if err != nil {
-        log.Fatalf("sheets: %v", err)
+        log.Fatalf("store: %v", err)
     }
 
     payProvider, err := payments.NewProvider(cfg)
@@ -36,12 +62,16 @@ func main() {
         log.Fatalf("payments: %v", err)
     }
 
-    botApp, err := tgbot.New(cfg, sheetsClient, payProvider)
+    sched, err := scheduler.New(scheduler.NewFileStore(filepath.Join(cfg.DataDir, "schedule.json")))
+    if err != nil {
+        log.Fatalf("scheduler: %v", err)
+    }
+    botApp, err := tgbot.New(cfg, db, payProvider, tgbot.FileStorage(cfg.DataDir), sched)
     if err != nil {
         log.Fatalf("telegram: %v", err)
     }
 
-    httpSrv := server.New(cfg, sheetsClient, payProvider, botApp)
+    httpSrv := server.New(cfg, db, payProvider, botApp)
 
     // Start HTTP server
     go func() {
@@ -53,17 +83,21 @@ func main() {
 
     // Start Telegram
     ctx, cancel := context.WithCancel(context.Background())
+    botDone := make(chan struct{})
     go func() {
-        if err := botApp.Run(ctx); err != nil {
+        defer close(botDone)
+        if err := botApp.Run(ctx); err != nil && ctx.Err() == nil {
             log.Printf("bot stopped: %v", err)
-            cancel()
         }
     }()
 
     // Graceful shutdown
     sig := make(chan os.Signal, 1)
     signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-    <-sig
+    select {
+    case <-sig:
+    case <-botDone:
+    }
     log.Println("shutting down...")
 
     cancel()
@@ -71,5 +105,71 @@ func main() {
     defer cancel2()
     _ = httpSrv.Shutdown(ctxTimeout)
 
+    // Run returns once queued updates are handled and background jobs saved
+    <-botDone
     log.Println("bye")
 }
+
+func openStore(cfg config.Config) (store.Store, error) {
+    switch cfg.Storage {
+    case "sheets":
+        c, err := sheets.New(cfg.GoogleServiceAccountJSON, cfg.SpreadsheetID, sheetsOptions(cfg))
+        if err != nil {
+            return nil, err
+        }
+        ctx := context.Background()
+        if cfg.SheetsAutoMigrate {
+            if err := c.EnsureHeaders(ctx); err != nil {
+                return nil, fmt.Errorf("migrate: %w", err)
+            }
+        }
+        if err := c.LoadColumns(ctx); err != nil {
+            return nil, fmt.Errorf("%w (run `bot migrate` or enable SHEETS_AUTO_MIGRATE)", err)
+        }
+        return c, nil
+    case "memory":
+        log.Println("storage: in-memory, data is lost on restart")
+        return memory.New(), nil
+    case "file":
+        return file.New(filepath.Join(cfg.DataDir, "store.json"))
+    default:
+        return nil, fmt.Errorf("unknown storage: %s", cfg.Storage)
+    }
+}
+
+// migrate creates missing tabs and headers in the spreadsheet and runs pending migrations.
+func migrate(cfg config.Config) error {
+    if cfg.Storage != "sheets" {
+        return fmt.Errorf("nothing to migrate for STORAGE=%s", cfg.Storage)
+    }
+    c, err := sheets.New(cfg.GoogleServiceAccountJSON, cfg.SpreadsheetID, sheetsOptions(cfg))
+    if err != nil {
+        return err
+    }
+    return c.EnsureHeaders(context.Background())
+}
+
+func sheetsOptions(cfg config.Config) sheets.Options {
+    return sheets.Options{
+        CacheTTL:    cfg.SheetsCacheTTL,
+        CallTimeout: cfg.SheetsCallTimeout,
+        MaxRetries:  cfg.SheetsMaxRetries,
+    }
+}
+
+// repairTeams gives teams with duplicate or empty team_id a unique one.
+func repairTeams(cfg config.Config) error {
+    if cfg.Storage != "sheets" {
+        return fmt.Errorf("nothing to repair for STORAGE=%s", cfg.Storage)
+    }
+    c, err := sheets.New(cfg.GoogleServiceAccountJSON, cfg.SpreadsheetID, sheetsOptions(cfg))
+    if err != nil {
+        return err
+    }
+    fixed, err := c.RepairTeamIDs(context.Background())
+    if err != nil {
+        return err
+    }
+    log.Printf("repair-teams: %d team ids fixed", fixed)
+    return nil
+}
@@ -5,13 +5,41 @@ import (
     "os"
     "strconv"
     "strings"
+    "time"
+
+    "karting-bot/internal/models"
+    "karting-bot/internal/util"
 )
 
 type Config struct {
     TelegramToken string
+    BotWorkers    int // updates handled in parallel (one user's updates stay in order)
+    StateTimeout  time.Duration // abandoned flows are reset after this
+    TimeZone      *time.Location // championship time zone: admins type dates in it
+
+    // how long before a stage registered pilots are reminded of it
+    ReminderOffsets []time.Duration
+    // pilots can cancel their registration until this long before the stage
+    CancelDeadline time.Duration
+    // main pilots per team on a stage that has no team_limit of its own
+    TeamMainLimit int
+    // how long a pilot from the waitlist has to accept a free place
+    OfferTTL time.Duration
+    // when unpaid main places are freed on stages without a pay_deadline
+    PayDeadline models.PayDeadline
+    // how long before the payment deadline the pilot is warned
+    PayWarning time.Duration
+
+    // Storage backend: sheets (default), memory or file
+    Storage string
+    DataDir string
 
     SpreadsheetID            string
     GoogleServiceAccountJSON string
+    SheetsAutoMigrate        bool // create missing tabs/columns on start
+    SheetsCacheTTL           time.Duration
+    SheetsCallTimeout        time.Duration
+    SheetsMaxRetries         int
 
     AdminTGIDs map[int64]bool
 
@@ -22,11 +50,57 @@ type Config struct {
     BasePublicURL string
 }
 
+// FromEnv reads the configuration of the bot.
 func FromEnv() (Config, error) {
-    var c Config
+    c, err := StorageFromEnv()
+    if err != nil {
+        return c, err
+    }
     c.TelegramToken = strings.TrimSpace(os.Getenv("TELEGRAM_BOT_TOKEN"))
-    c.SpreadsheetID = strings.TrimSpace(os.Getenv("GOOGLE_SHEETS_SPREADSHEET_ID"))
-    c.GoogleServiceAccountJSON = strings.TrimSpace(os.Getenv("GOOGLE_SERVICE_ACCOUNT_JSON"))
+    if c.BotWorkers, err = envInt("BOT_WORKERS", 8); err != nil {
+        return c, err
+    }
+    if c.StateTimeout, err = envDuration("STATE_TIMEOUT", 30*time.Minute); err != nil {
+        return c, err
+    }
+
+    tz := strings.TrimSpace(os.Getenv("TIMEZONE"))
+    if tz == "" {
+        tz = "Europe/Moscow"
+    }
+    if c.TimeZone, err = time.LoadLocation(tz); err != nil {
+        return c, fmt.Errorf("TIMEZONE: %w", err)
+    }
+
+    if c.ReminderOffsets, err = envDurations("REMINDER_OFFSETS", []time.Duration{72 * time.Hour, 3 * time.Hour}); err != nil {
+        return c, err
+    }
+
+    if c.CancelDeadline, err = envDuration("CANCEL_DEADLINE", 24*time.Hour); err != nil {
+        return c, err
+    }
+    if c.TeamMainLimit, err = envInt("TEAM_MAIN_LIMIT", 3); err != nil {
+        return c, err
+    }
+    if c.TeamMainLimit < 1 {
+        return c, fmt.Errorf("TEAM_MAIN_LIMIT must be at least 1")
+    }
+    offerHours, err := envInt("WAITLIST_OFFER_HOURS", 12)
+    if err != nil {
+        return c, err
+    }
+    if offerHours < 1 {
+        return c, fmt.Errorf("WAITLIST_OFFER_HOURS must be at least 1")
+    }
+    c.OfferTTL = time.Duration(offerHours) * time.Hour
+    if v := strings.TrimSpace(os.Getenv("PAY_DEADLINE")); v != "" {
+        if c.PayDeadline, err = models.ParsePayDeadline(v); err != nil {
+            return c, fmt.Errorf("PAY_DEADLINE: %w", err)
+        }
+    }
+    if c.PayWarning, err = envDuration("PAY_WARNING", 24*time.Hour); err != nil {
+        return c, err
+    }
 
     c.PaymentProvider = strings.TrimSpace(os.Getenv("PAYMENT_PROVIDER"))
     if c.PaymentProvider == "" {
@@ -47,15 +121,54 @@ func FromEnv() (Config, error) {
     if c.TelegramToken == "" {
         return c, fmt.Errorf("TELEGRAM_BOT_TOKEN is empty")
     }
-    if c.SpreadsheetID == "" {
-        return c, fmt.Errorf("GOOGLE_SHEETS_SPREADSHEET_ID is empty")
+
+    c.AdminTGIDs = parseAdminIDs(os.Getenv("ADMIN_TG_IDS"))
+
+    return c, nil
+}
+
+// StorageFromEnv reads only the storage settings: the maintenance commands
+// like migrate need no bot token or payment settings.
+func StorageFromEnv() (Config, error) {
+    var c Config
+    c.Storage = strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE")))
+    if c.Storage == "" {
+        c.Storage = "sheets"
     }
-    if c.GoogleServiceAccountJSON == "" {
-        return c, fmt.Errorf("GOOGLE_SERVICE_ACCOUNT_JSON is empty")
+    c.DataDir = strings.TrimSpace(os.Getenv("DATA_DIR"))
+    if c.DataDir == "" {
+        c.DataDir = "./data"
     }
 
-    c.AdminTGIDs = parseAdminIDs(os.Getenv("ADMIN_TG_IDS"))
+    c.SpreadsheetID = strings.TrimSpace(os.Getenv("GOOGLE_SHEETS_SPREADSHEET_ID"))
+    c.GoogleServiceAccountJSON = strings.TrimSpace(os.Getenv("GOOGLE_SERVICE_ACCOUNT_JSON"))
+    c.SheetsAutoMigrate = true
+    if v := strings.TrimSpace(os.Getenv("SHEETS_AUTO_MIGRATE")); v != "" {
+        c.SheetsAutoMigrate = util.NormalizeBoolRU(v)
+    }
+    var err error
+    if c.SheetsCacheTTL, err = envDuration("SHEETS_CACHE_TTL", 30*time.Second); err != nil {
+        return c, err
+    }
+    if c.SheetsCallTimeout, err = envDuration("SHEETS_CALL_TIMEOUT", 10*time.Second); err != nil {
+        return c, err
+    }
+    if c.SheetsMaxRetries, err = envInt("SHEETS_MAX_RETRIES", 4); err != nil {
+        return c, err
+    }
 
+    switch c.Storage {
+    case "sheets":
+        if c.SpreadsheetID == "" {
+            return c, fmt.Errorf("GOOGLE_SHEETS_SPREADSHEET_ID is empty")
+        }
+        if c.GoogleServiceAccountJSON == "" {
+            return c, fmt.Errorf("GOOGLE_SERVICE_ACCOUNT_JSON is empty")
+        }
+    case "memory", "file":
+    default:
+        return c, fmt.Errorf("unknown STORAGE: %s", c.Storage)
+    }
     return c, nil
 }
 
@@ -79,3 +192,50 @@ func parseAdminIDs(raw string) map[int64]bool {
     }
     return m
 }
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def, nil
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        return 0, fmt.Errorf("%s: %w", name, err)
+    }
+    return d, nil
+}
+
+func envInt(name string, def int) (int, error) {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def, nil
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        return 0, fmt.Errorf("%s: %w", name, err)
+    }
+    return n, nil
+}
+
+// envDurations reads a comma-separated list like "72h,3h". "0" means an empty list.
+func envDurations(name string, def []time.Duration) ([]time.Duration, error) {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def, nil
+    }
+    if v == "0" {
+        return nil, nil
+    }
+    out := []time.Duration{}
+    for _, p := range strings.Split(v, ",") {
+        d, err := time.ParseDuration(strings.TrimSpace(p))
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+        if d <= 0 {
+            return nil, fmt.Errorf("%s: %s must be positive", name, p)
+        }
+        out = append(out, d)
+    }
+    return out, nil
+}
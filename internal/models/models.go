@@ -1,5 +1,14 @@
 package models
 
+import (
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+
+    "karting-bot/internal/util"
+)
+
 type Participant struct {
     TgID      int64
     FirstName string
@@ -16,31 +25,161 @@ type Team struct {
 }
 
 type Stage struct {
-    StageID  string
-    Title    string
-    Date     string
-    Time     string
-    Place    string
-    Address  string
-    RegOpen  string // "да"/"нет" or "true"/"false" (we normalize)
-    Price    string
+    StageID     string
+    Title       string
+    Date        string
+    Time        string
+    Place       string
+    Address     string
+    RegOpen     string // "да"/"нет" or "true"/"false" (we normalize); kept in sync with Status
+    Price       string
+    Status      string // see Stage* statuses
+    Capacity    string // karts on the track, i.e. main pilots of all teams; empty or 0: no limit
+    TeamLimit   string // main pilots per team; empty: the default of the bot
+    PayDeadline string // see ParsePayDeadline; empty: the default of the bot
+}
+
+// Stage statuses. A stage goes draft → reg_open ⇄ reg_closed → running →
+// finished, and may be cancelled at any point before it is finished.
+const (
+    StageDraft     = "draft"
+    StageRegOpen   = "reg_open"
+    StageRegClosed = "reg_closed"
+    StageRunning   = "running"
+    StageFinished  = "finished" // results are published
+    StageCancelled = "cancelled"
+)
+
+var stageTransitions = map[string][]string{
+    StageDraft:     {StageRegOpen, StageCancelled},
+    StageRegOpen:   {StageRegClosed, StageCancelled},
+    StageRegClosed: {StageRegOpen, StageRunning, StageCancelled},
+    StageRunning:   {StageFinished, StageCancelled},
+}
+
+// NextStatuses are the statuses a stage in status can move to.
+func NextStatuses(status string) []string {
+    return stageTransitions[status]
+}
+
+// CanMoveStage tells whether a stage may go from one status to another.
+func CanMoveStage(from, to string) bool {
+    for _, s := range stageTransitions[from] {
+        if s == to {
+            return true
+        }
+    }
+    return false
+}
+
+// LegacyStageStatus is the status of a stage saved before statuses existed,
+// when only reg_open was known.
+func LegacyStageStatus(regOpen string) string {
+    if util.NormalizeBoolRU(regOpen) {
+        return StageRegOpen
+    }
+    return StageRegClosed
+}
+
+// SetStatus changes Status and keeps RegOpen in line with it.
+func (s *Stage) SetStatus(status string) {
+    s.Status = status
+    s.RegOpen = "нет"
+    if status == StageRegOpen {
+        s.RegOpen = "да"
+    }
+}
+
+// StartsAt is when the stage begins: Date and Time in the championship time
+// zone loc. ok is false when they can't be read, e.g. in old free-text rows.
+func (s Stage) StartsAt(loc *time.Location) (t time.Time, ok bool) {
+    t, err := util.CombineDateClock(s.Date, s.Time, loc)
+    return t, err == nil
+}
+
+// PayDeadline is when an unpaid registration runs out: After its creation,
+// or Before the stage start, whichever comes first. Zero fields are unset.
+type PayDeadline struct {
+    After  time.Duration
+    Before time.Duration
+}
+
+var errPayDeadline = errors.New("не понял срок оплаты: нужно, например, «48h» (через 48 часов после записи), «-3d» (за 3 дня до этапа), «48h,-3d» (что раньше) или «0» (без срока)")
+
+// ParsePayDeadline reads a comma-separated deadline like "48h", "-3d" or
+// "48h,-3d": a plain duration counts from the registration, a negative one
+// back from the stage start. Units are h and d. "0" means no deadline.
+func ParsePayDeadline(v string) (PayDeadline, error) {
+    var d PayDeadline
+    v = strings.TrimSpace(v)
+    if v == "0" {
+        return d, nil
+    }
+    for _, part := range strings.Split(v, ",") {
+        part = strings.TrimSpace(part)
+        before := strings.HasPrefix(part, "-")
+        part = strings.TrimPrefix(part, "-")
+        if len(part) < 2 {
+            return PayDeadline{}, errPayDeadline
+        }
+        n, err := strconv.Atoi(part[:len(part)-1])
+        if err != nil || n <= 0 {
+            return PayDeadline{}, errPayDeadline
+        }
+        var unit time.Duration
+        switch part[len(part)-1] {
+        case 'h':
+            unit = time.Hour
+        case 'd':
+            unit = 24 * time.Hour
+        default:
+            return PayDeadline{}, errPayDeadline
+        }
+        if before {
+            d.Before = time.Duration(n) * unit
+        } else {
+            d.After = time.Duration(n) * unit
+        }
+    }
+    return d, nil
+}
+
+// IsZero tells that there is no deadline.
+func (d PayDeadline) IsZero() bool {
+    return d.After == 0 && d.Before == 0
+}
+
+// Due is the deadline of a registration created at created on a stage
+// starting at start; a zero time is unknown. ok is false when neither part
+// of the deadline applies.
+func (d PayDeadline) Due(created, start time.Time) (due time.Time, ok bool) {
+    if d.After > 0 && !created.IsZero() {
+        due, ok = created.Add(d.After), true
+    }
+    if d.Before > 0 && !start.IsZero() {
+        if t := start.Add(-d.Before); !ok || t.Before(due) {
+            due, ok = t, true
+        }
+    }
+    return due, ok
 }
 
 type Registration struct {
     StageID   string
     TgID      int64
     TeamName  string
-    Role      string // main/reserve
+    Role      string // main/reserve/waitlist/offered
     PayStatus string // unpaid/paid/cancelled
     CreatedAt string
+    Refund    string // ""/requested/failed: refund of a paid registration that was cancelled
 }
 
 type Result struct {
-    StageID   string
-    TgID      int64
-    BestTime  string
-    Position  string
-    Points    string
+    StageID  string
+    TgID     int64
+    BestTime string
+    Position string
+    Points   string
 }
 
 type Photo struct {
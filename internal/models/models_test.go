@@ -0,0 +1,86 @@
+package models
+
+import (
+    "testing"
+    "time"
+)
+
+func TestStageTransitions(t *testing.T) {
+    allowed := [][2]string{
+        {StageDraft, StageRegOpen},
+        {StageRegOpen, StageRegClosed},
+        {StageRegClosed, StageRegOpen},
+        {StageRegClosed, StageRunning},
+        {StageRunning, StageFinished},
+        {StageDraft, StageCancelled},
+        {StageRunning, StageCancelled},
+    }
+    for _, m := range allowed {
+        if !CanMoveStage(m[0], m[1]) {
+            t.Errorf("%s → %s should be allowed", m[0], m[1])
+        }
+    }
+    denied := [][2]string{
+        {StageDraft, StageRunning},
+        {StageRegOpen, StageFinished},
+        {StageFinished, StageCancelled},
+        {StageCancelled, StageRegOpen},
+        {StageRunning, StageRegOpen},
+        {"", StageRegOpen},
+    }
+    for _, m := range denied {
+        if CanMoveStage(m[0], m[1]) {
+            t.Errorf("%s → %s should be denied", m[0], m[1])
+        }
+    }
+}
+
+func TestSetStatusKeepsRegOpen(t *testing.T) {
+    var s Stage
+    s.SetStatus(StageRegOpen)
+    if s.RegOpen != "да" {
+        t.Errorf("reg_open = %q, want да", s.RegOpen)
+    }
+    s.SetStatus(StageRunning)
+    if s.RegOpen != "нет" {
+        t.Errorf("running: reg_open = %q, want нет", s.RegOpen)
+    }
+    if LegacyStageStatus(s.RegOpen) != StageRegClosed || LegacyStageStatus("true") != StageRegOpen {
+        t.Error("legacy status does not follow reg_open")
+    }
+}
+
+func TestParsePayDeadline(t *testing.T) {
+    cases := map[string]PayDeadline{
+        "48h":      {After: 48 * time.Hour},
+        "-3d":      {Before: 72 * time.Hour},
+        "48h, -3d": {After: 48 * time.Hour, Before: 72 * time.Hour},
+        "0":        {},
+    }
+    for v, want := range cases {
+        if got, err := ParsePayDeadline(v); err != nil || got != want {
+            t.Errorf("ParsePayDeadline(%q) = %+v, %v; want %+v", v, got, err, want)
+        }
+    }
+    for _, v := range []string{"", "48", "2w", "-0d", "h", "48h,"} {
+        if _, err := ParsePayDeadline(v); err == nil {
+            t.Errorf("ParsePayDeadline(%q) accepted", v)
+        }
+    }
+}
+
+func TestPayDeadlineDue(t *testing.T) {
+    created := time.Date(2030, 6, 1, 10, 0, 0, 0, time.UTC)
+    start := time.Date(2030, 6, 10, 10, 0, 0, 0, time.UTC)
+    d := PayDeadline{After: 48 * time.Hour, Before: 3 * 24 * time.Hour}
+    if due, ok := d.Due(created, start); !ok || !due.Equal(created.Add(48*time.Hour)) {
+        t.Errorf("due = %v, %v; want 48h after the registration", due, ok)
+    }
+    late := time.Date(2030, 6, 6, 10, 0, 0, 0, time.UTC)
+    if due, ok := d.Due(late, start); !ok || !due.Equal(start.Add(-72*time.Hour)) {
+        t.Errorf("due = %v, %v; want 3 days before the start", due, ok)
+    }
+    if _, ok := (PayDeadline{Before: time.Hour}).Due(created, time.Time{}); ok {
+        t.Error("a deadline before an unknown start must not apply")
+    }
+}
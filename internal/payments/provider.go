@@ -5,9 +5,14 @@ import "context"
 type PaymentProvider interface {
 	Name() string
 
-	// Возвращает ссылку на оплату и invoice
-	CreatePayment(ctx context.Context, stageID string, tgID int64, amount string, returnURL string) (payURL string, invoice string, err error)
+	// Возвращает ссылку на оплату и invoice. ref — created_at записи, за
+	// которую платят: вебхук вернёт его, чтобы оплату отменённой записи не
+	// засчитали новой записи того же пилота
+	CreatePayment(ctx context.Context, stageID string, tgID int64, ref string, amount string, returnURL string) (payURL string, invoice string, err error)
 
-	// Валидирует вебхук и возвращает (stageID, tgID, status=paid/cancelled)
-	HandleWebhook(ctx context.Context, body []byte, headers map[string]string) (stageID string, tgID int64, status string, err error)
+	// Валидирует вебхук и возвращает (stageID, tgID, ref, status=paid/cancelled)
+	HandleWebhook(ctx context.Context, body []byte, headers map[string]string) (stageID string, tgID int64, ref string, status string, err error)
+
+	// Запрашивает возврат оплаты участия и возвращает id возврата у провайдера
+	Refund(ctx context.Context, stageID string, tgID int64, amount string) (refundID string, err error)
 }
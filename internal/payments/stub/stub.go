@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	neturl "net/url"
 	"strings"
+	"time"
 
 	"karting-bot/internal/util"
 )
@@ -24,36 +26,45 @@ func New(secret, baseURL string) *Provider {
 
 func (p *Provider) Name() string { return "stub" }
 
-func (p *Provider) CreatePayment(ctx context.Context, stageID string, tgID int64, amount string, returnURL string) (string, string, error) {
-	invoice := fmt.Sprintf("%s:%d:%s", stageID, tgID, util.NowISO())
+func (p *Provider) CreatePayment(ctx context.Context, stageID string, tgID int64, ref string, amount string, returnURL string) (string, string, error) {
+	// ref идёт последним: в нём есть двоеточия
+	invoice := fmt.Sprintf("%s:%d:%d:%s", stageID, tgID, time.Now().UnixNano(), ref)
 
-	url := "/pay/stub?invoice=" + invoice
+	url := "/pay/stub?invoice=" + neturl.QueryEscape(invoice)
 	if p.baseURL != "" {
 		url = p.baseURL + url
 	}
 	return url, invoice, nil
 }
 
+// Refund: у тестового провайдера возврат всегда проходит сразу.
+func (p *Provider) Refund(ctx context.Context, stageID string, tgID int64, amount string) (string, error) {
+	return fmt.Sprintf("refund:%s:%d:%s", stageID, tgID, util.NowISO()), nil
+}
+
 type webhookPayload struct {
 	Invoice string `json:"invoice"`
 	Status  string `json:"status"` // paid/cancelled
 }
 
-func (p *Provider) HandleWebhook(ctx context.Context, body []byte, headers map[string]string) (stageID string, tgID int64, status string, err error) {
+func (p *Provider) HandleWebhook(ctx context.Context, body []byte, headers map[string]string) (stageID string, tgID int64, ref string, status string, err error) {
 	sig := headers["x-signature"]
 	expected := util.HMACSHA256Hex(p.secret, string(body))
 	if sig == "" || sig != expected {
-		return "", 0, "", fmt.Errorf("invalid signature")
+		return "", 0, "", "", fmt.Errorf("invalid signature")
 	}
 
 	var pl webhookPayload
 	if err := json.Unmarshal(body, &pl); err != nil {
-		return "", 0, "", err
+		return "", 0, "", "", err
 	}
 
-	parts := strings.Split(pl.Invoice, ":")
+	parts := strings.SplitN(pl.Invoice, ":", 4)
 	if len(parts) < 2 {
-		return "", 0, "", fmt.Errorf("bad invoice")
+		return "", 0, "", "", fmt.Errorf("bad invoice")
+	}
+	if len(parts) == 4 {
+		ref = parts[3]
 	}
 	stageID = parts[0]
 
@@ -65,5 +76,5 @@ func (p *Provider) HandleWebhook(ctx context.Context, body []byte, headers map[s
 	if status == "" {
 		status = "paid"
 	}
-	return stageID, tgID, status, nil
+	return stageID, tgID, ref, status, nil
 }
@@ -0,0 +1,79 @@
+// Package persist keeps the bot's own small data sets, like conversation
+// state or scheduled jobs, in JSON files so they survive restarts.
+package persist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Store loads and saves one value of T as a whole.
+type Store[T any] interface {
+	Load() (T, error)
+	Save(v T) error
+}
+
+// Memory keeps nothing between restarts: Load returns the zero T.
+type Memory[T any] struct{}
+
+func (Memory[T]) Load() (T, error) {
+	var v T
+	return v, nil
+}
+
+func (Memory[T]) Save(T) error { return nil }
+
+// File keeps the value in one JSON file. Before the first save Load returns
+// the zero T.
+type File[T any] struct {
+	path string
+}
+
+func NewFile[T any](path string) *File[T] {
+	return &File[T]{path: path}
+}
+
+func (f *File[T]) Load() (T, error) {
+	var v T
+	err := LoadJSON(f.path, &v)
+	return v, err
+}
+
+func (f *File[T]) Save(v T) error {
+	return SaveJSON(f.path, v)
+}
+
+// LoadJSON reads path into v. A missing file leaves v as is.
+func LoadJSON(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// SaveJSON writes v to a temp file and renames it over path, so a crash
+// never leaves half a file.
+func SaveJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,35 @@
+package persist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "marks.json")
+	f := NewFile[map[string]int](path)
+	if v, err := f.Load(); err != nil || v != nil {
+		t.Fatalf("load before the first save = %v, %v; want nil", v, err)
+	}
+	if err := f.Save(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := f.Load()
+	if err != nil || v["a"] != 1 {
+		t.Fatalf("load = %v, %v; want a=1", v, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
+
+func TestLoadBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFile[[]int](path).Load(); err == nil {
+		t.Error("a broken file must not load as empty")
+	}
+}
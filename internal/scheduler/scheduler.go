@@ -0,0 +1,271 @@
+// Package scheduler runs jobs at a set time. Pending jobs are persisted, so
+// they survive restarts; a job whose time passed while the bot was down runs
+// right after the start.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"karting-bot/internal/persist"
+)
+
+var ErrNotFound = errors.New("scheduled job not found")
+
+const (
+	// retryDelay is how long a failed job waits before the next attempt.
+	retryDelay = time.Minute
+	// maxAttempts is how many times a job is tried before it is dropped.
+	maxAttempts = 5
+)
+
+// Job is one scheduled action. Kind selects the handler, Data is its input.
+type Job struct {
+	ID        string
+	Kind      string
+	RunAt     time.Time
+	Data      map[string]string
+	CreatedBy int64
+	CreatedAt time.Time
+	Attempts  int
+}
+
+// Handler runs a due job. A returned error makes the job run again later.
+type Handler func(ctx context.Context, j Job) error
+
+// Store persists pending jobs.
+type Store = persist.Store[[]Job]
+
+// MemoryStore keeps nothing between restarts.
+type MemoryStore = persist.Memory[[]Job]
+
+// NewFileStore keeps the jobs in one JSON file.
+func NewFileStore(path string) Store {
+	return persist.NewFile[[]Job](path)
+}
+
+type Scheduler struct {
+	store    Store
+	mu       sync.Mutex
+	jobs     map[string]Job
+	handlers map[string]Handler
+	wake     chan struct{}
+	now      func() time.Time
+}
+
+func New(store Store) (*Scheduler, error) {
+	loaded, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	s := &Scheduler{
+		store:    store,
+		jobs:     map[string]Job{},
+		handlers: map[string]Handler{},
+		wake:     make(chan struct{}, 1),
+		now:      time.Now,
+	}
+	for _, j := range loaded {
+		s.jobs[j.ID] = j
+	}
+	return s, nil
+}
+
+// Handle registers the handler for jobs of kind. Call it before Run.
+func (s *Scheduler) Handle(kind string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[kind] = h
+}
+
+// Add schedules j and returns it with the id set.
+func (s *Scheduler) Add(j Job) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.ID = s.newID()
+	if j.CreatedAt.IsZero() {
+		j.CreatedAt = s.now()
+	}
+	s.jobs[j.ID] = j
+	return j, s.changed()
+}
+
+// Update replaces the job with the same id.
+func (s *Scheduler) Update(j Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[j.ID]; !ok {
+		return ErrNotFound
+	}
+	j.Attempts = 0
+	s.jobs[j.ID] = j
+	return s.changed()
+}
+
+func (s *Scheduler) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.jobs, id)
+	return s.changed()
+}
+
+func (s *Scheduler) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// List returns the pending jobs of kind, soonest first.
+func (s *Scheduler) List(kind string) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Job{}
+	for _, j := range s.jobs {
+		if j.Kind == kind {
+			out = append(out, j)
+		}
+	}
+	sortJobs(out)
+	return out
+}
+
+// Run executes due jobs until ctx is done. Jobs run one at a time.
+func (s *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		for _, j := range s.due() {
+			s.run(ctx, j)
+		}
+
+		wait := time.Hour
+		if next, ok := s.next(); ok {
+			wait = next.Sub(s.now())
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, j Job) {
+	s.mu.Lock()
+	h := s.handlers[j.Kind]
+	s.mu.Unlock()
+
+	var err error
+	if h == nil {
+		err = fmt.Errorf("no handler for kind %q", j.Kind)
+	} else {
+		err = h(ctx, j)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.jobs[j.ID]
+	if !ok || !cur.RunAt.Equal(j.RunAt) {
+		// removed or rescheduled while running
+		return
+	}
+	if err == nil {
+		delete(s.jobs, j.ID)
+	} else if cur.Attempts+1 >= maxAttempts {
+		log.Printf("scheduler: job %s (%s) dropped after %d attempts: %v", j.ID, j.Kind, maxAttempts, err)
+		delete(s.jobs, j.ID)
+	} else {
+		log.Printf("scheduler: job %s (%s) failed, retrying in %s: %v", j.ID, j.Kind, retryDelay, err)
+		cur.Attempts++
+		cur.RunAt = s.now().Add(retryDelay)
+		s.jobs[j.ID] = cur
+	}
+	if err := s.save(); err != nil {
+		log.Printf("scheduler: save: %v", err)
+	}
+}
+
+func (s *Scheduler) due() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	out := []Job{}
+	for _, j := range s.jobs {
+		if !j.RunAt.After(now) {
+			out = append(out, j)
+		}
+	}
+	sortJobs(out)
+	return out
+}
+
+func (s *Scheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next time.Time
+	for _, j := range s.jobs {
+		if next.IsZero() || j.RunAt.Before(next) {
+			next = j.RunAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// changed must be called with the lock held. It saves the jobs and wakes Run
+// so a new or moved job is not missed.
+func (s *Scheduler) changed() error {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return s.save()
+}
+
+func (s *Scheduler) save() error {
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sortJobs(jobs)
+	return s.store.Save(jobs)
+}
+
+// newID must be called with the lock held.
+func (s *Scheduler) newID() string {
+	n := s.now().UnixNano()
+	for {
+		id := strconv.FormatInt(n, 36)
+		if _, taken := s.jobs[id]; !taken {
+			return id
+		}
+		n++
+	}
+}
+
+func sortJobs(jobs []Job) {
+	sort.Slice(jobs, func(i, k int) bool {
+		if !jobs[i].RunAt.Equal(jobs[k].RunAt) {
+			return jobs[i].RunAt.Before(jobs[k].RunAt)
+		}
+		return jobs[i].ID < jobs[k].ID
+	})
+}
@@ -0,0 +1,116 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunsDueJobsAndKeepsFutureOnes(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "jobs.json"))
+	s, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan string, 10)
+	s.Handle("test", func(ctx context.Context, j Job) error {
+		ran <- j.Data["name"]
+		return nil
+	})
+
+	if _, err := s.Add(Job{Kind: "test", RunAt: time.Now().Add(-time.Minute), Data: map[string]string{"name": "past"}}); err != nil {
+		t.Fatal(err)
+	}
+	future, err := s.Add(Job{Kind: "test", RunAt: time.Now().Add(time.Hour), Data: map[string]string{"name": "future"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case name := <-ran:
+		if name != "past" {
+			t.Fatalf("ran %q first", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("due job did not run")
+	}
+
+	// moving a job closer must wake the loop
+	future.RunAt = time.Now().Add(50 * time.Millisecond)
+	if err := s.Update(future); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-ran:
+		if name != "future" {
+			t.Fatalf("ran %q", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("rescheduled job did not run")
+	}
+	cancel()
+	<-done
+
+	reloaded, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(reloaded.List("test")); n != 0 {
+		t.Errorf("%d jobs left after running", n)
+	}
+}
+
+func TestFailedJobIsRetried(t *testing.T) {
+	s, err := New(MemoryStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle("test", func(ctx context.Context, j Job) error {
+		return errors.New("boom")
+	})
+	j, _ := s.Add(Job{Kind: "test", RunAt: time.Now().Add(-time.Second)})
+
+	s.run(context.Background(), j)
+
+	got, ok := s.Get(j.ID)
+	if !ok {
+		t.Fatal("failed job was dropped")
+	}
+	if got.Attempts != 1 || !got.RunAt.After(time.Now()) {
+		t.Errorf("got attempts %d, run at %v", got.Attempts, got.RunAt)
+	}
+}
+
+func TestPersistsPendingJobs(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "jobs.json"))
+	s, _ := New(store)
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	j, err := s.Add(Job{Kind: "test", RunAt: at, Data: map[string]string{"k": "v"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := reloaded.Get(j.ID)
+	if !ok || !got.RunAt.Equal(at) || got.Data["k"] != "v" {
+		t.Fatalf("got %+v, %v", got, ok)
+	}
+	if err := reloaded.Remove(j.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Remove(j.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second remove: %v", err)
+	}
+}
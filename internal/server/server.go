@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -9,12 +10,12 @@ import (
 
 	"karting-bot/internal/config"
 	"karting-bot/internal/payments"
-	"karting-bot/internal/sheets"
+	"karting-bot/internal/store"
 	"karting-bot/internal/tgbot"
 	"karting-bot/internal/util"
 )
 
-func New(cfg config.Config, sh *sheets.Client, pay payments.PaymentProvider, bot *tgbot.App) *http.Server {
+func New(cfg config.Config, db store.Store, pay payments.PaymentProvider, bot *tgbot.App) *http.Server {
 	mux := http.NewServeMux()
 
 	// Stub payment page (for testing)
@@ -67,7 +68,7 @@ async function hmac(body){ return ""; }
 			headers["x-signature"] = util.HMACSHA256Hex(cfg.PaymentWebhookSecret, string(body))
 		}
 
-		stageID, tgID, status, err := pay.HandleWebhook(r.Context(), body, headers)
+		stageID, tgID, ref, status, err := pay.HandleWebhook(r.Context(), body, headers)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -80,13 +81,29 @@ async function hmac(body){ return ""; }
 			payStatus = "cancelled"
 		}
 
-		if err := sh.UpdatePayStatus(stageID, tgID, payStatus); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// the bot checks the registration first: a payment for a registration
+		// cancelled meanwhile is refunded instead of bringing it back
+		applied := false
+		if payStatus == "cancelled" {
+			// a main pilot without payment gives the place to the team's reserve
+			applied, err = bot.PaymentCancelled(r.Context(), stageID, tgID, ref)
+		} else {
+			applied, err = bot.PaymentConfirmed(r.Context(), stageID, tgID, ref)
+		}
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, store.ErrUnavailable) {
+				code = http.StatusServiceUnavailable // provider will redeliver the webhook
+			}
+			http.Error(w, err.Error(), code)
 			return
 		}
 
-		// Notify user in Telegram
+		// Notify user in Telegram; about a refunded payment the bot told them already
 		go func() {
+			if !applied {
+				return
+			}
 			msg := "✅ Оплата подтверждена. Участие в этапе закреплено."
 			if payStatus == "cancelled" {
 				msg = "❌ Оплата отменена."
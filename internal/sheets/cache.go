@@ -0,0 +1,106 @@
+package sheets
+
+import (
+    "context"
+    "time"
+)
+
+// Columns every tab is indexed by, so hot lookups don't scan whole sheets.
+var indexed = map[string][]string{
+    SheetParticipants:  {"tg_id"},
+    SheetTeams:         {"team_id"},
+    SheetStages:        {"stage_id"},
+    SheetRegistrations: {"stage_id", "tg_id"},
+    SheetResults:       {"stage_id", "tg_id"},
+    SheetPhotos:        {"stage_id"},
+}
+
+// table is a cached snapshot of one tab.
+type table struct {
+    loadedAt time.Time
+    recs     []record
+    index    map[string]map[string][]int // column -> value -> positions in recs
+}
+
+func newTable(sheet string, recs []record) *table {
+    t := &table{loadedAt: time.Now(), recs: recs, index: map[string]map[string][]int{}}
+    for _, col := range indexed[sheet] {
+        m := map[string][]int{}
+        for i, r := range recs {
+            v := r.get(col)
+            m[v] = append(m[v], i)
+        }
+        t.index[col] = m
+    }
+    return t
+}
+
+// lookup returns records whose col equals value, in sheet order.
+func (t *table) lookup(col, value string) []record {
+    m, ok := t.index[col]
+    if !ok {
+        out := []record{}
+        for _, r := range t.recs {
+            if r.get(col) == value {
+                out = append(out, r)
+            }
+        }
+        return out
+    }
+    out := make([]record, 0, len(m[value]))
+    for _, i := range m[value] {
+        out = append(out, t.recs[i])
+    }
+    return out
+}
+
+// first returns the first record whose col equals value.
+func (t *table) first(col, value string) (record, bool) {
+    rs := t.lookup(col, value)
+    if len(rs) == 0 {
+        return record{}, false
+    }
+    return rs[0], true
+}
+
+// table returns the cached snapshot of sheet, reloading it when older than the cache TTL.
+// A zero TTL disables caching.
+func (c *Client) table(ctx context.Context, sheet string) (*table, error) {
+    c.mu.RLock()
+    t := c.cache[sheet]
+    c.mu.RUnlock()
+    if t != nil && c.opts.CacheTTL > 0 && time.Since(t.loadedAt) < c.opts.CacheTTL {
+        return t, nil
+    }
+
+    return c.reload(ctx, sheet)
+}
+
+// reload reads sheet from the API and replaces the cached snapshot.
+// Writes locate rows with it, so row numbers are never stale. A read that
+// started before a write invalidated sheet is returned to its caller but
+// not cached.
+func (c *Client) reload(ctx context.Context, sheet string) (*table, error) {
+    c.mu.RLock()
+    gen := c.gens[sheet]
+    c.mu.RUnlock()
+    recs, err := c.records(ctx, sheet)
+    if err != nil {
+        return nil, err
+    }
+    t := newTable(sheet, recs)
+    c.mu.Lock()
+    if c.gens[sheet] == gen {
+        c.cache[sheet] = t
+    }
+    c.mu.Unlock()
+    return t, nil
+}
+
+// invalidate drops the cached snapshot after a write to sheet.
+func (c *Client) invalidate(sheet string) {
+    c.mu.Lock()
+    delete(c.cache, sheet)
+    c.gens[sheet]++
+    c.mu.Unlock()
+}
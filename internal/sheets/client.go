@@ -4,17 +4,52 @@ import (
     "context"
     "fmt"
     "os"
+    "sync"
+    "time"
 
     "google.golang.org/api/option"
     sheetsv4 "google.golang.org/api/sheets/v4"
+
+    "karting-bot/internal/store"
 )
 
+type Options struct {
+    // CacheTTL is how long a read tab is served from memory. Writes done
+    // through the client invalidate the tab immediately. 0 disables the cache.
+    CacheTTL time.Duration
+
+    // Every API call gets CallTimeout (0 = only the caller's context).
+    // Retryable errors (429, 5xx, timeouts) are retried up to MaxRetries
+    // times with exponential backoff from RetryBaseDelay to RetryMaxDelay.
+    CallTimeout    time.Duration
+    MaxRetries     int
+    RetryBaseDelay time.Duration
+    RetryMaxDelay  time.Duration
+}
+
 type Client struct {
     srv *sheetsv4.Service
     spreadsheetID string
+    opts Options
+
+    mu    sync.RWMutex
+    cols  map[string]columns // header mapping per tab
+    cache map[string]*table
+    gens  map[string]uint64 // per tab, bumped by invalidate
+
+    stageLocks store.KeyedMutex
+    teamsMu    sync.Mutex // serializes team creation and id repair
 }
 
-func New(serviceAccountJSONPath, spreadsheetID string) (*Client, error) {
+// New connects to the spreadsheet. Call EnsureHeaders (optional) and then
+// LoadColumns before using the client.
+func New(serviceAccountJSONPath, spreadsheetID string, opts Options) (*Client, error) {
+    if opts.RetryBaseDelay <= 0 {
+        opts.RetryBaseDelay = 500 * time.Millisecond
+    }
+    if opts.RetryMaxDelay < opts.RetryBaseDelay {
+        opts.RetryMaxDelay = 16 * opts.RetryBaseDelay
+    }
     if _, err := os.Stat(serviceAccountJSONPath); err != nil {
         return nil, fmt.Errorf("service account json: %w", err)
     }
@@ -26,7 +61,14 @@ func New(serviceAccountJSONPath, spreadsheetID string) (*Client, error) {
     if err != nil {
         return nil, err
     }
-    return &Client{srv: srv, spreadsheetID: spreadsheetID}, nil
+    return &Client{
+        srv:           srv,
+        spreadsheetID: spreadsheetID,
+        opts:          opts,
+        cols:          map[string]columns{},
+        cache:         map[string]*table{},
+        gens:          map[string]uint64{},
+    }, nil
 }
 
 func (c *Client) SpreadsheetID() string { return c.spreadsheetID }
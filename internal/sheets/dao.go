@@ -9,107 +9,179 @@ import (
     sheetsv4 "google.golang.org/api/sheets/v4"
 
     "karting-bot/internal/models"
+    "karting-bot/internal/store"
     "karting-bot/internal/util"
 )
 
 const (
-    SheetParticipants       = "Participants"
-    SheetTeams              = "Teams"
-    SheetStages             = "Stages"
-    SheetRegistrations      = "Stage_Registrations"
-    SheetResults            = "Results"
-    SheetPhotos             = "Photos"
+    SheetParticipants  = "Participants"
+    SheetTeams         = "Teams"
+    SheetStages        = "Stages"
+    SheetRegistrations = "Stage_Registrations"
+    SheetResults       = "Results"
+    SheetPhotos        = "Photos"
 )
 
-func (c *Client) readAll(sheet string) ([][]interface{}, error) {
-    resp, err := c.srv.Spreadsheets.Values.Get(c.spreadsheetID, sheet+"!A:Z").Do()
+var _ store.Store = (*Client)(nil)
+
+func (c *Client) readAll(ctx context.Context, sheet string) ([][]interface{}, error) {
+    var resp *sheetsv4.ValueRange
+    err := c.call(ctx, true, func(ctx context.Context) (err error) {
+        resp, err = c.srv.Spreadsheets.Values.Get(c.spreadsheetID, sheet).Context(ctx).Do()
+        return err
+    })
     if err != nil {
         return nil, err
     }
     return resp.Values, nil
 }
 
-func (c *Client) appendRow(sheet string, row []interface{}) error {
-    vr := &sheetsv4.ValueRange{Values: [][]interface{}{row}}
-    _, err := c.srv.Spreadsheets.Values.Append(c.spreadsheetID, sheet+"!A:Z", vr).
-        ValueInputOption("RAW").
-        InsertDataOption("INSERT_ROWS").
-        Do()
+// records reads all data rows of a tab. The header row is re-parsed on every
+// read, so columns moved by an organiser are picked up without a restart.
+func (c *Client) records(ctx context.Context, sheet string) ([]record, error) {
+    values, err := c.readAll(ctx, sheet)
+    if err != nil {
+        return nil, err
+    }
+    if len(values) == 0 {
+        return nil, fmt.Errorf("sheet %s: header row is empty", sheet)
+    }
+    cols := parseHeader(values[0])
+    for _, h := range schema[sheet] {
+        if _, ok := cols[h]; !ok {
+            return nil, fmt.Errorf("sheet %s: missing column %s", sheet, h)
+        }
+    }
+    c.mu.Lock()
+    c.cols[sheet] = cols
+    c.mu.Unlock()
+
+    out := []record{}
+    for i := 1; i < len(values); i++ {
+        if len(values[i]) == 0 {
+            continue
+        }
+        out = append(out, record{num: i + 1, row: values[i], cols: cols})
+    }
+    return out, nil
+}
+
+func (c *Client) appendRecord(ctx context.Context, sheet string, values map[string]interface{}) error {
+    vr := &sheetsv4.ValueRange{Values: [][]interface{}{c.makeRow(sheet, values)}}
+    err := c.call(ctx, false, func(ctx context.Context) error {
+        _, err := c.srv.Spreadsheets.Values.Append(c.spreadsheetID, sheet+"!A1", vr).
+            ValueInputOption("RAW").
+            InsertDataOption("INSERT_ROWS").
+            Context(ctx).
+            Do()
+        return err
+    })
+    c.invalidate(sheet)
     return err
 }
 
-func (c *Client) updateCell(sheet, a1 string, value interface{}) error {
+func (c *Client) updateField(ctx context.Context, sheet string, rowNum int, col string, value interface{}) error {
+    a1, err := c.cellA1(sheet, col, rowNum)
+    if err != nil {
+        return err
+    }
     vr := &sheetsv4.ValueRange{Values: [][]interface{}{{value}}}
-    _, err := c.srv.Spreadsheets.Values.Update(c.spreadsheetID, sheet+"!"+a1, vr).
-        ValueInputOption("RAW").
-        Do()
+    err = c.call(ctx, true, func(ctx context.Context) error {
+        _, err := c.srv.Spreadsheets.Values.Update(c.spreadsheetID, sheet+"!"+a1, vr).
+            ValueInputOption("RAW").
+            Context(ctx).
+            Do()
+        return err
+    })
+    c.invalidate(sheet)
+    return err
+}
+
+// updateFields writes several cells of one row in a single request.
+func (c *Client) updateFields(ctx context.Context, sheet string, rowNum int, values map[string]interface{}) error {
+    data := []*sheetsv4.ValueRange{}
+    for col, v := range values {
+        a1, err := c.cellA1(sheet, col, rowNum)
+        if err != nil {
+            return err
+        }
+        data = append(data, &sheetsv4.ValueRange{Range: sheet + "!" + a1, Values: [][]interface{}{{v}}})
+    }
+    if len(data) == 0 {
+        return nil
+    }
+    req := &sheetsv4.BatchUpdateValuesRequest{ValueInputOption: "RAW", Data: data}
+    err := c.call(ctx, true, func(ctx context.Context) error {
+        _, err := c.srv.Spreadsheets.Values.BatchUpdate(c.spreadsheetID, req).Context(ctx).Do()
+        return err
+    })
+    c.invalidate(sheet)
     return err
 }
 
 // ---------- Participants ----------
 
-func (c *Client) GetParticipant(tgID int64) (*models.Participant, int, error) {
-    values, err := c.readAll(SheetParticipants)
+func participantFrom(r record) models.Participant {
+    tgID, _ := strconv.ParseInt(r.get("tg_id"), 10, 64)
+    return models.Participant{
+        TgID:      tgID,
+        FirstName: r.get("first_name"),
+        LastName:  r.get("last_name"),
+        Nick:      r.get("nick"),
+        TeamName:  r.get("team_name"),
+        CreatedAt: r.get("created_at"),
+    }
+}
+
+func (c *Client) GetParticipant(ctx context.Context, tgID int64) (*models.Participant, error) {
+    t, err := c.table(ctx, SheetParticipants)
     if err != nil {
-        return nil, 0, err
+        return nil, err
     }
-    // header row at index 0
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if len(row) < 1 {
-            continue
-        }
-        if fmt.Sprint(row[0]) == strconv.FormatInt(tgID, 10) {
-            p := &models.Participant{
-                TgID:      tgID,
-                FirstName: get(row, 1),
-                LastName:  get(row, 2),
-                Nick:      get(row, 3),
-                TeamName:  get(row, 4),
-                CreatedAt: get(row, 5),
-            }
-            return p, i + 1, nil // sheet rows are 1-indexed; i is 0-indexed in values
-        }
+    r, ok := t.first("tg_id", strconv.FormatInt(tgID, 10))
+    if !ok {
+        return nil, nil
     }
-    return nil, 0, nil
+    p := participantFrom(r)
+    return &p, nil
 }
 
-func (c *Client) CreateParticipant(p models.Participant) error {
-    return c.appendRow(SheetParticipants, []interface{}{
-        p.TgID, p.FirstName, p.LastName, p.Nick, p.TeamName, p.CreatedAt,
+func (c *Client) CreateParticipant(ctx context.Context, p models.Participant) error {
+    return c.appendRecord(ctx, SheetParticipants, map[string]interface{}{
+        "tg_id":      p.TgID,
+        "first_name": p.FirstName,
+        "last_name":  p.LastName,
+        "nick":       p.Nick,
+        "team_name":  p.TeamName,
+        "created_at": p.CreatedAt,
     })
 }
 
-func (c *Client) UpdateParticipantTeam(tgID int64, teamName string) error {
-    _, rowNum, err := c.GetParticipant(tgID)
+func (c *Client) UpdateParticipantTeam(ctx context.Context, tgID int64, teamName string) error {
+    t, err := c.reload(ctx, SheetParticipants)
     if err != nil {
         return err
     }
-    if rowNum == 0 {
-        return fmt.Errorf("participant not found")
+    r, ok := t.first("tg_id", strconv.FormatInt(tgID, 10))
+    if !ok {
+        return fmt.Errorf("participant: %w", store.ErrNotFound)
     }
-    // column E = 5th column
-    a1 := fmt.Sprintf("E%d", rowNum)
-    return c.updateCell(SheetParticipants, a1, teamName)
+    return c.updateField(ctx, SheetParticipants, r.num, "team_name", teamName)
 }
 
 // ---------- Teams ----------
 
-func (c *Client) ListTeams() ([]models.Team, error) {
-    values, err := c.readAll(SheetTeams)
+func (c *Client) ListTeams(ctx context.Context) ([]models.Team, error) {
+    t, err := c.table(ctx, SheetTeams)
     if err != nil {
         return nil, err
     }
     teams := []models.Team{}
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if len(row) == 0 {
-            continue
-        }
+    for _, r := range t.recs {
         t := models.Team{
-            TeamID:    get(row, 0),
-            TeamName:  get(row, 1),
-            CreatedAt: get(row, 2),
+            TeamID:    r.get("team_id"),
+            TeamName:  r.get("team_name"),
+            CreatedAt: r.get("created_at"),
         }
         if strings.TrimSpace(t.TeamName) != "" {
             teams = append(teams, t)
@@ -118,64 +190,142 @@ func (c *Client) ListTeams() ([]models.Team, error) {
     return teams, nil
 }
 
-func (c *Client) CreateTeam(name string) (models.Team, error) {
+func (c *Client) GetTeam(ctx context.Context, teamID string) (*models.Team, error) {
+    t, err := c.table(ctx, SheetTeams)
+    if err != nil {
+        return nil, err
+    }
+    r, ok := t.first("team_id", teamID)
+    if !ok {
+        return nil, nil
+    }
+    return &models.Team{
+        TeamID:    r.get("team_id"),
+        TeamName:  r.get("team_name"),
+        CreatedAt: r.get("created_at"),
+    }, nil
+}
+
+func (c *Client) CreateTeam(ctx context.Context, name string) (models.Team, error) {
     name = strings.TrimSpace(name)
     if name == "" {
         return models.Team{}, fmt.Errorf("team name empty")
     }
-    // generate team_id: short slug
-    id := slug(name)
-    t := models.Team{TeamID: id, TeamName: name, CreatedAt: util.NowISO()}
-    if err := c.appendRow(SheetTeams, []interface{}{t.TeamID, t.TeamName, t.CreatedAt}); err != nil {
+    c.teamsMu.Lock()
+    defer c.teamsMu.Unlock()
+
+    t, err := c.reload(ctx, SheetTeams)
+    if err != nil {
         return models.Team{}, err
     }
-    return t, nil
+    teams := []models.Team{}
+    taken := map[string]bool{}
+    for _, r := range t.recs {
+        teams = append(teams, models.Team{TeamID: r.get("team_id"), TeamName: r.get("team_name")})
+        taken[r.get("team_id")] = true
+    }
+    if _, ok := store.FindTeamByName(teams, name); ok {
+        return models.Team{}, store.ErrTeamExists
+    }
+
+    team := models.Team{TeamID: store.NewTeamID(name, taken), TeamName: name, CreatedAt: util.NowISO()}
+    err = c.appendRecord(ctx, SheetTeams, map[string]interface{}{
+        "team_id":    team.TeamID,
+        "team_name":  team.TeamName,
+        "created_at": team.CreatedAt,
+    })
+    if err != nil {
+        return models.Team{}, err
+    }
+    return team, nil
 }
 
-func slug(s string) string {
-    s = strings.ToLower(strings.TrimSpace(s))
-    b := strings.Builder{}
-    for _, r := range s {
-        if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
-            b.WriteRune(r)
-        } else if r == ' ' || r == '-' || r == '_' {
-            b.WriteRune('-')
-        }
+// RepairTeamIDs gives every team with an empty or duplicate team_id a new
+// unique one. The first team keeps a shared id. Returns how many rows changed.
+func (c *Client) RepairTeamIDs(ctx context.Context) (int, error) {
+    c.teamsMu.Lock()
+    defer c.teamsMu.Unlock()
+
+    t, err := c.reload(ctx, SheetTeams)
+    if err != nil {
+        return 0, err
     }
-    out := strings.Trim(b.String(), "-")
-    if out == "" {
-        out = "team"
+    taken := map[string]bool{}
+    for _, r := range t.recs {
+        taken[r.get("team_id")] = true
+    }
+    seen := map[string]bool{}
+    fixed := 0
+    for _, r := range t.recs {
+        id := strings.TrimSpace(r.get("team_id"))
+        if id != "" && !seen[id] {
+            seen[id] = true
+            continue
+        }
+        newID := store.NewTeamID(r.get("team_name"), taken)
+        if err := c.updateField(ctx, SheetTeams, r.num, "team_id", newID); err != nil {
+            return fixed, err
+        }
+        taken[newID] = true
+        seen[newID] = true
+        fixed++
     }
-    return out
+    return fixed, nil
 }
 
 // ---------- Stages ----------
 
-func (c *Client) ListStages(all bool) ([]models.Stage, error) {
-    values, err := c.readAll(SheetStages)
+func stageFrom(r record) models.Stage {
+    s := models.Stage{
+        StageID:     r.get("stage_id"),
+        Title:       r.get("title"),
+        Date:        r.get("date"),
+        Time:        r.get("time"),
+        Place:       r.get("place"),
+        Address:     r.get("address"),
+        RegOpen:     r.get("reg_open"),
+        Price:       r.get("price"),
+        Status:      strings.TrimSpace(r.get("status")),
+        Capacity:    r.get("capacity"),
+        TeamLimit:   r.get("team_limit"),
+        PayDeadline: r.get("pay_deadline"),
+    }
+    if s.Status == "" {
+        // a row added by hand
+        s.Status = models.LegacyStageStatus(s.RegOpen)
+    }
+    return s
+}
+
+// fillStageStatuses sets status of the stages created before it existed from reg_open.
+func (c *Client) fillStageStatuses(ctx context.Context) error {
+    t, err := c.reload(ctx, SheetStages)
     if err != nil {
-        return nil, err
+        return err
     }
-    stages := []models.Stage{}
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if len(row) == 0 {
+    for _, r := range t.recs {
+        if r.get("stage_id") == "" || strings.TrimSpace(r.get("status")) != "" {
             continue
         }
-        st := models.Stage{
-            StageID: get(row, 0),
-            Title:   get(row, 1),
-            Date:    get(row, 2),
-            Time:    get(row, 3),
-            Place:   get(row, 4),
-            Address: get(row, 5),
-            RegOpen: get(row, 6),
-            Price:   get(row, 7),
+        if err := c.updateField(ctx, SheetStages, r.num, "status", models.LegacyStageStatus(r.get("reg_open"))); err != nil {
+            return err
         }
+    }
+    return nil
+}
+
+func (c *Client) ListStages(ctx context.Context, all bool) ([]models.Stage, error) {
+    t, err := c.table(ctx, SheetStages)
+    if err != nil {
+        return nil, err
+    }
+    stages := []models.Stage{}
+    for _, r := range t.recs {
+        st := stageFrom(r)
         if strings.TrimSpace(st.StageID) == "" || strings.TrimSpace(st.Title) == "" {
             continue
         }
-        if !all && !util.NormalizeBoolRU(st.RegOpen) {
+        if !all && st.Status != models.StageRegOpen {
             continue
         }
         stages = append(stages, st)
@@ -183,196 +333,296 @@ func (c *Client) ListStages(all bool) ([]models.Stage, error) {
     return stages, nil
 }
 
-func (c *Client) GetStage(stageID string) (*models.Stage, error) {
-    stages, err := c.ListStages(true)
+func (c *Client) GetStage(ctx context.Context, stageID string) (*models.Stage, error) {
+    t, err := c.table(ctx, SheetStages)
     if err != nil {
         return nil, err
     }
-    for _, s := range stages {
-        if s.StageID == stageID {
-            ss := s
-            return &ss, nil
+    for _, r := range t.lookup("stage_id", stageID) {
+        st := stageFrom(r)
+        if strings.TrimSpace(st.Title) == "" {
+            continue
         }
+        return &st, nil
     }
     return nil, nil
 }
 
-func (c *Client) CreateStage(s models.Stage) error {
-    return c.appendRow(SheetStages, []interface{}{
-        s.StageID, s.Title, s.Date, s.Time, s.Place, s.Address, s.RegOpen, s.Price,
+func (c *Client) CreateStage(ctx context.Context, s models.Stage) error {
+    return c.appendRecord(ctx, SheetStages, map[string]interface{}{
+        "stage_id":     s.StageID,
+        "title":        s.Title,
+        "date":         s.Date,
+        "time":         s.Time,
+        "place":        s.Place,
+        "address":      s.Address,
+        "reg_open":     s.RegOpen,
+        "price":        s.Price,
+        "status":       s.Status,
+        "capacity":     s.Capacity,
+        "team_limit":   s.TeamLimit,
+        "pay_deadline": s.PayDeadline,
     })
 }
 
-func (c *Client) SetStageRegOpen(stageID string, open bool) error {
-    values, err := c.readAll(SheetStages)
+// UpdateStage writes only the cells that changed, so formatting and formulas
+// elsewhere in the row are left alone.
+func (c *Client) UpdateStage(ctx context.Context, s models.Stage) error {
+    t, err := c.reload(ctx, SheetStages)
     if err != nil {
         return err
     }
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if get(row, 0) == stageID {
-            rowNum := i + 1
-            a1 := fmt.Sprintf("G%d", rowNum) // reg_open column
-            if open {
-                return c.updateCell(SheetStages, a1, "да")
-            }
-            return c.updateCell(SheetStages, a1, "нет")
+    r, ok := t.first("stage_id", s.StageID)
+    if !ok {
+        return fmt.Errorf("stage: %w", store.ErrNotFound)
+    }
+    changed := map[string]interface{}{}
+    for col, v := range map[string]string{
+        "title":        s.Title,
+        "date":         s.Date,
+        "time":         s.Time,
+        "place":        s.Place,
+        "address":      s.Address,
+        "reg_open":     s.RegOpen,
+        "price":        s.Price,
+        "status":       s.Status,
+        "capacity":     s.Capacity,
+        "team_limit":   s.TeamLimit,
+        "pay_deadline": s.PayDeadline,
+    } {
+        if r.get(col) != v {
+            changed[col] = v
         }
     }
-    return fmt.Errorf("stage not found")
+    return c.updateFields(ctx, SheetStages, r.num, changed)
 }
 
 // ---------- Registrations ----------
 
-func (c *Client) ListRegistrationsForStage(stageID string) ([]models.Registration, error) {
-    values, err := c.readAll(SheetRegistrations)
+func registrationFrom(r record) models.Registration {
+    tgID, _ := strconv.ParseInt(r.get("tg_id"), 10, 64)
+    return models.Registration{
+        StageID:   r.get("stage_id"),
+        TgID:      tgID,
+        TeamName:  r.get("team_name"),
+        Role:      r.get("role"),
+        PayStatus: r.get("pay_status"),
+        CreatedAt: r.get("created_at"),
+        Refund:    r.get("refund"),
+    }
+}
+
+func (c *Client) ListRegistrationsForStage(ctx context.Context, stageID string) ([]models.Registration, error) {
+    t, err := c.table(ctx, SheetRegistrations)
     if err != nil {
         return nil, err
     }
+    return stageRegistrations(t, stageID), nil
+}
+
+// stageRegistrations is the current registrations of stageID in t.
+func stageRegistrations(t *table, stageID string) []models.Registration {
     regs := []models.Registration{}
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if len(row) == 0 {
-            continue
-        }
-        if get(row, 0) != stageID {
-            continue
-        }
-        tgID, _ := strconv.ParseInt(get(row, 1), 10, 64)
-        regs = append(regs, models.Registration{
-            StageID:   stageID,
-            TgID:      tgID,
-            TeamName:  get(row, 2),
-            Role:      get(row, 3),
-            PayStatus: get(row, 4),
-            CreatedAt: get(row, 5),
-        })
+    for _, r := range t.lookup("stage_id", stageID) {
+        regs = append(regs, registrationFrom(r))
     }
-    return regs, nil
+    return store.Latest(regs)
 }
 
-func (c *Client) HasRegistration(stageID string, tgID int64) (bool, error) {
-    values, err := c.readAll(SheetRegistrations)
+func (c *Client) ListRegistrationsForPilot(ctx context.Context, tgID int64) ([]models.Registration, error) {
+    t, err := c.table(ctx, SheetRegistrations)
     if err != nil {
-        return false, err
+        return nil, err
     }
+    regs := []models.Registration{}
+    for _, r := range t.lookup("tg_id", strconv.FormatInt(tgID, 10)) {
+        regs = append(regs, registrationFrom(r))
+    }
+    return store.Latest(regs), nil
+}
+
+// findRegistration returns the current registration record from t, if any:
+// a pilot who registered again after cancelling has a row per registration,
+// the latest is the lowest.
+func findRegistration(t *table, stageID string, tgID int64) (record, bool) {
     tg := strconv.FormatInt(tgID, 10)
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if get(row, 0) == stageID && get(row, 1) == tg {
-            return true, nil
+    var found record
+    ok := false
+    for _, r := range t.lookup("stage_id", stageID) {
+        if r.get("tg_id") == tg {
+            found, ok = r, true
         }
     }
-    return false, nil
+    return found, ok
+}
+
+func (c *Client) HasRegistration(ctx context.Context, stageID string, tgID int64) (bool, error) {
+    t, err := c.table(ctx, SheetRegistrations)
+    if err != nil {
+        return false, err
+    }
+    _, ok := findRegistration(t, stageID, tgID)
+    return ok, nil
 }
 
-func (c *Client) CreateRegistration(r models.Registration) error {
-    return c.appendRow(SheetRegistrations, []interface{}{
-        r.StageID, r.TgID, r.TeamName, r.Role, r.PayStatus, r.CreatedAt,
+func (c *Client) CreateRegistration(ctx context.Context, r models.Registration) error {
+    return c.appendRecord(ctx, SheetRegistrations, map[string]interface{}{
+        "stage_id":   r.StageID,
+        "tg_id":      r.TgID,
+        "team_name":  r.TeamName,
+        "role":       r.Role,
+        "pay_status": r.PayStatus,
+        "created_at": r.CreatedAt,
+        "refund":     r.Refund,
     })
 }
 
-func (c *Client) UpdatePayStatus(stageID string, tgID int64, payStatus string) error {
-    values, err := c.readAll(SheetRegistrations)
+// RegisterForStage holds the stage lock while it checks and appends, so two
+// presses at the same moment can't both take the last main slot. The lock is
+// per process: run a single bot instance against one spreadsheet.
+func (c *Client) RegisterForStage(ctx context.Context, r models.Registration, lim store.Limits) (models.Registration, error) {
+    unlock := c.stageLocks.Lock(r.StageID)
+    defer unlock()
+
+    t, err := c.reload(ctx, SheetRegistrations)
     if err != nil {
-        return err
+        return r, err
     }
-    tg := strconv.FormatInt(tgID, 10)
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if get(row, 0) == stageID && get(row, 1) == tg {
-            rowNum := i + 1
-            a1 := fmt.Sprintf("E%d", rowNum) // pay_status
-            return c.updateCell(SheetRegistrations, a1, payStatus)
-        }
+    if ex, found := findRegistration(t, r.StageID, r.TgID); found && ex.get("pay_status") != "cancelled" {
+        return r, store.ErrAlreadyRegistered
+    }
+    // after a cancel the old row stays with its refund state: a late
+    // payment for it must not pay for the new one
+    r.Role = store.PickRole(stageRegistrations(t, r.StageID), r.TeamName, lim)
+    return r, c.CreateRegistration(ctx, r)
+}
+
+// PromoteReserve holds the stage lock like RegisterForStage, so a new
+// registration can't take the freed place at the same moment.
+func (c *Client) PromoteReserve(ctx context.Context, stageID, teamName string, lim store.Limits) (*models.Registration, error) {
+    unlock := c.stageLocks.Lock(stageID)
+    defer unlock()
+
+    t, err := c.reload(ctx, SheetRegistrations)
+    if err != nil {
+        return nil, err
+    }
+    stageRegs := stageRegistrations(t, stageID)
+    if store.CountMain(stageRegs, teamName) >= lim.TeamMain || store.StageFull(stageRegs, lim) {
+        return nil, nil
+    }
+    next, ok := store.NextReserve(stageRegs, teamName)
+    if !ok {
+        return nil, nil
     }
-    return fmt.Errorf("registration not found")
+    rec, _ := findRegistration(t, stageID, next.TgID)
+    if err := c.updateField(ctx, SheetRegistrations, rec.num, "role", "main"); err != nil {
+        return nil, err
+    }
+    next.Role = "main"
+    return &next, nil
 }
 
-func (c *Client) UpdateRole(stageID string, tgID int64, role string) error {
-    values, err := c.readAll(SheetRegistrations)
+// OfferWaitlist holds the stage lock like RegisterForStage.
+func (c *Client) OfferWaitlist(ctx context.Context, stageID string, lim store.Limits) (*models.Registration, error) {
+    unlock := c.stageLocks.Lock(stageID)
+    defer unlock()
+
+    t, err := c.reload(ctx, SheetRegistrations)
+    if err != nil {
+        return nil, err
+    }
+    stageRegs := stageRegistrations(t, stageID)
+    next, ok := store.NextWaitlisted(stageRegs, lim)
+    if !ok {
+        return nil, nil
+    }
+    rec, _ := findRegistration(t, stageID, next.TgID)
+    if err := c.updateField(ctx, SheetRegistrations, rec.num, "role", "offered"); err != nil {
+        return nil, err
+    }
+    next.Role = "offered"
+    return &next, nil
+}
+
+func (c *Client) UpdatePayStatus(ctx context.Context, stageID string, tgID int64, payStatus string) error {
+    return c.updateRegistrationField(ctx, stageID, tgID, "pay_status", payStatus)
+}
+
+func (c *Client) UpdateRole(ctx context.Context, stageID string, tgID int64, role string) error {
+    return c.updateRegistrationField(ctx, stageID, tgID, "role", role)
+}
+
+func (c *Client) UpdateRefund(ctx context.Context, stageID string, tgID int64, refund string) error {
+    return c.updateRegistrationField(ctx, stageID, tgID, "refund", refund)
+}
+
+func (c *Client) updateRegistrationField(ctx context.Context, stageID string, tgID int64, col, value string) error {
+    t, err := c.reload(ctx, SheetRegistrations)
     if err != nil {
         return err
     }
-    tg := strconv.FormatInt(tgID, 10)
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if get(row, 0) == stageID && get(row, 1) == tg {
-            rowNum := i + 1
-            a1 := fmt.Sprintf("D%d", rowNum) // role
-            return c.updateCell(SheetRegistrations, a1, role)
-        }
+    r, ok := findRegistration(t, stageID, tgID)
+    if !ok {
+        return fmt.Errorf("registration: %w", store.ErrNotFound)
     }
-    return fmt.Errorf("registration not found")
+    return c.updateField(ctx, SheetRegistrations, r.num, col, value)
 }
 
 // Count main pilots for team on stage
-func (c *Client) CountMainForTeam(stageID, teamName string) (int, error) {
-    regs, err := c.ListRegistrationsForStage(stageID)
+func (c *Client) CountMainForTeam(ctx context.Context, stageID, teamName string) (int, error) {
+    regs, err := c.ListRegistrationsForStage(ctx, stageID)
     if err != nil {
         return 0, err
     }
-    cnt := 0
-    for _, r := range regs {
-        if strings.EqualFold(strings.TrimSpace(r.TeamName), strings.TrimSpace(teamName)) && r.Role == "main" {
-            cnt++
-        }
-    }
-    return cnt, nil
+    return store.CountMain(regs, teamName), nil
 }
 
 // ---------- Results & Photos ----------
 
-func (c *Client) GetResult(stageID string, tgID int64) (*models.Result, error) {
-    values, err := c.readAll(SheetResults)
+func (c *Client) GetResult(ctx context.Context, stageID string, tgID int64) (*models.Result, error) {
+    t, err := c.table(ctx, SheetResults)
     if err != nil {
         return nil, err
     }
     tg := strconv.FormatInt(tgID, 10)
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if get(row, 0) == stageID && get(row, 1) == tg {
+    for _, r := range t.lookup("stage_id", stageID) {
+        if r.get("tg_id") == tg {
             return &models.Result{
-                StageID:   stageID,
-                TgID:      tgID,
-                BestTime:  get(row, 2),
-                Position:  get(row, 3),
-                Points:    get(row, 4),
+                StageID:  stageID,
+                TgID:     tgID,
+                BestTime: r.get("best_time"),
+                Position: r.get("position"),
+                Points:   r.get("points"),
             }, nil
         }
     }
     return nil, nil
 }
 
-func (c *Client) SumPointsForUser(tgID int64) (int, error) {
-    values, err := c.readAll(SheetResults)
+func (c *Client) SumPointsForUser(ctx context.Context, tgID int64) (int, error) {
+    t, err := c.table(ctx, SheetResults)
     if err != nil {
         return 0, err
     }
-    tg := strconv.FormatInt(tgID, 10)
     sum := 0
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if get(row, 1) == tg {
-            p, _ := strconv.Atoi(strings.TrimSpace(get(row, 4)))
-            sum += p
-        }
+    for _, r := range t.lookup("tg_id", strconv.FormatInt(tgID, 10)) {
+        p, _ := strconv.Atoi(strings.TrimSpace(r.get("points")))
+        sum += p
     }
     return sum, nil
 }
 
-func (c *Client) GetPhoto(stageID string) (*models.Photo, error) {
-    values, err := c.readAll(SheetPhotos)
+func (c *Client) GetPhoto(ctx context.Context, stageID string) (*models.Photo, error) {
+    t, err := c.table(ctx, SheetPhotos)
     if err != nil {
         return nil, err
     }
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if get(row, 0) == stageID {
-            return &models.Photo{StageID: stageID, URL: get(row, 1)}, nil
-        }
+    r, ok := t.first("stage_id", stageID)
+    if !ok {
+        return nil, nil
     }
-    return nil, nil
+    return &models.Photo{StageID: stageID, URL: r.get("url")}, nil
 }
 
 // ---------- helpers ----------
@@ -383,9 +633,3 @@ func get(row []interface{}, idx int) string {
     }
     return fmt.Sprint(row[idx])
 }
-
-func (c *Client) EnsureHeaders() error {
-    // optional helper: do nothing (headers are created manually). Kept for extension.
-    _ = context.Background()
-    return nil
-}
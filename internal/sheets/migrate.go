@@ -0,0 +1,208 @@
+package sheets
+
+import (
+    "context"
+    "fmt"
+    "strconv"
+
+    sheetsv4 "google.golang.org/api/sheets/v4"
+)
+
+// SheetMeta keeps key/value settings of the spreadsheet itself, e.g. schema_version.
+const SheetMeta = "Meta"
+
+var metaHeaders = []string{"key", "value"}
+
+const metaSchemaVersion = "schema_version"
+
+// migration upgrades data once headers are in place. Migrations run in order
+// of version and each one runs only once per spreadsheet.
+type migration struct {
+    version int
+    name    string
+    apply   func(ctx context.Context, c *Client) error
+}
+
+var migrations = []migration{
+    {version: 1, name: "initial tabs and headers", apply: func(ctx context.Context, c *Client) error { return nil }},
+    {version: 2, name: "unique team ids", apply: func(ctx context.Context, c *Client) error {
+        _, err := c.RepairTeamIDs(ctx)
+        return err
+    }},
+    {version: 3, name: "stage statuses", apply: func(ctx context.Context, c *Client) error {
+        return c.fillStageStatuses(ctx)
+    }},
+}
+
+// SchemaVersion is the version a fully migrated spreadsheet has.
+func SchemaVersion() int {
+    return migrations[len(migrations)-1].version
+}
+
+// EnsureHeaders creates missing tabs, appends missing header columns and runs
+// pending migrations. It is safe to call on every start.
+func (c *Client) EnsureHeaders(ctx context.Context) error {
+    var ss *sheetsv4.Spreadsheet
+    err := c.call(ctx, true, func(ctx context.Context) (err error) {
+        ss, err = c.srv.Spreadsheets.Get(c.spreadsheetID).Context(ctx).Do()
+        return err
+    })
+    if err != nil {
+        return fmt.Errorf("read spreadsheet: %w", err)
+    }
+    props := map[string]*sheetsv4.SheetProperties{}
+    for _, sh := range ss.Sheets {
+        if sh.Properties != nil {
+            props[sh.Properties.Title] = sh.Properties
+        }
+    }
+
+    tabs := append(append([]string{}, sheetOrder...), SheetMeta)
+    reqs := []*sheetsv4.Request{}
+    for _, tab := range tabs {
+        if _, ok := props[tab]; !ok {
+            reqs = append(reqs, &sheetsv4.Request{AddSheet: &sheetsv4.AddSheetRequest{
+                Properties: &sheetsv4.SheetProperties{Title: tab},
+            }})
+        }
+    }
+    if len(reqs) > 0 {
+        var resp *sheetsv4.BatchUpdateSpreadsheetResponse
+        err := c.call(ctx, false, func(ctx context.Context) (err error) {
+            resp, err = c.srv.Spreadsheets.BatchUpdate(c.spreadsheetID, &sheetsv4.BatchUpdateSpreadsheetRequest{Requests: reqs}).Context(ctx).Do()
+            return err
+        })
+        if err != nil {
+            return fmt.Errorf("create tabs: %w", err)
+        }
+        for _, r := range resp.Replies {
+            if r.AddSheet != nil && r.AddSheet.Properties != nil {
+                props[r.AddSheet.Properties.Title] = r.AddSheet.Properties
+            }
+        }
+    }
+
+    for _, tab := range tabs {
+        headers := schema[tab]
+        if tab == SheetMeta {
+            headers = metaHeaders
+        }
+        p, ok := props[tab]
+        if !ok {
+            return fmt.Errorf("create tabs: no %s in the reply", tab)
+        }
+        if err := c.ensureColumns(ctx, p, headers); err != nil {
+            return err
+        }
+    }
+
+    return c.migrate(ctx)
+}
+
+// ensureColumns appends the headers missing in the first row, widening the grid if needed.
+func (c *Client) ensureColumns(ctx context.Context, p *sheetsv4.SheetProperties, headers []string) error {
+    header, err := c.readHeader(ctx, p.Title)
+    if err != nil {
+        return err
+    }
+    cols := parseHeader(header)
+    missing := []interface{}{}
+    for _, h := range headers {
+        if _, ok := cols[h]; !ok {
+            missing = append(missing, h)
+        }
+    }
+    if len(missing) == 0 {
+        return nil
+    }
+
+    start := len(header)
+    need := int64(start + len(missing))
+    if p.GridProperties != nil && p.GridProperties.ColumnCount < need {
+        req := &sheetsv4.Request{AppendDimension: &sheetsv4.AppendDimensionRequest{
+            SheetId:   p.SheetId,
+            Dimension: "COLUMNS",
+            Length:    need - p.GridProperties.ColumnCount,
+        }}
+        err := c.call(ctx, false, func(ctx context.Context) error {
+            _, err := c.srv.Spreadsheets.BatchUpdate(c.spreadsheetID, &sheetsv4.BatchUpdateSpreadsheetRequest{Requests: []*sheetsv4.Request{req}}).Context(ctx).Do()
+            return err
+        })
+        if err != nil {
+            return fmt.Errorf("widen %s: %w", p.Title, err)
+        }
+    }
+
+    a1 := fmt.Sprintf("%s!%s1", p.Title, columnLetter(start))
+    vr := &sheetsv4.ValueRange{Values: [][]interface{}{missing}}
+    err = c.call(ctx, true, func(ctx context.Context) error {
+        _, err := c.srv.Spreadsheets.Values.Update(c.spreadsheetID, a1, vr).ValueInputOption("RAW").Context(ctx).Do()
+        return err
+    })
+    if err != nil {
+        return fmt.Errorf("write %s header: %w", p.Title, err)
+    }
+    return nil
+}
+
+func (c *Client) migrate(ctx context.Context) error {
+    current, rowNum, err := c.readSchemaVersion(ctx)
+    if err != nil {
+        return err
+    }
+    for _, m := range migrations {
+        if m.version <= current {
+            continue
+        }
+        if err := m.apply(ctx, c); err != nil {
+            return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+        }
+        if err := c.writeSchemaVersion(ctx, rowNum, m.version); err != nil {
+            return err
+        }
+        if rowNum == 0 {
+            // appended just now; re-read to learn the row for the next update
+            if _, rowNum, err = c.readSchemaVersion(ctx); err != nil {
+                return err
+            }
+        }
+        current = m.version
+    }
+    return nil
+}
+
+func (c *Client) readSchemaVersion(ctx context.Context) (version, rowNum int, err error) {
+    values, err := c.readAll(ctx, SheetMeta)
+    if err != nil {
+        return 0, 0, err
+    }
+    for i := 1; i < len(values); i++ {
+        if get(values[i], 0) == metaSchemaVersion {
+            v, _ := strconv.Atoi(get(values[i], 1))
+            return v, i + 1, nil
+        }
+    }
+    return 0, 0, nil
+}
+
+func (c *Client) writeSchemaVersion(ctx context.Context, rowNum, version int) error {
+    if rowNum == 0 {
+        vr := &sheetsv4.ValueRange{Values: [][]interface{}{{metaSchemaVersion, version}}}
+        return c.call(ctx, false, func(ctx context.Context) error {
+            _, err := c.srv.Spreadsheets.Values.Append(c.spreadsheetID, SheetMeta+"!A1", vr).
+                ValueInputOption("RAW").
+                InsertDataOption("INSERT_ROWS").
+                Context(ctx).
+                Do()
+            return err
+        })
+    }
+    vr := &sheetsv4.ValueRange{Values: [][]interface{}{{version}}}
+    return c.call(ctx, true, func(ctx context.Context) error {
+        _, err := c.srv.Spreadsheets.Values.Update(c.spreadsheetID, fmt.Sprintf("%s!B%d", SheetMeta, rowNum), vr).
+            ValueInputOption("RAW").
+            Context(ctx).
+            Do()
+        return err
+    })
+}
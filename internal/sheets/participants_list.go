@@ -1,23 +1,20 @@
 package sheets
 
 import (
-    "fmt"
+    "context"
     "strconv"
+
+    "karting-bot/internal/models"
 )
 
-func (c *Client) ListParticipantIDs() ([]int64, error) {
-    values, err := c.readAll(SheetParticipants)
+func (c *Client) ListParticipantIDs(ctx context.Context) ([]int64, error) {
+    t, err := c.table(ctx, SheetParticipants)
     if err != nil {
         return nil, err
     }
     out := []int64{}
-    for i := 1; i < len(values); i++ {
-        row := values[i]
-        if len(row) < 1 {
-            continue
-        }
-        idStr := fmt.Sprint(row[0])
-        id, err := strconv.ParseInt(idStr, 10, 64)
+    for _, r := range t.recs {
+        id, err := strconv.ParseInt(r.get("tg_id"), 10, 64)
         if err != nil {
             continue
         }
@@ -25,3 +22,19 @@ func (c *Client) ListParticipantIDs() ([]int64, error) {
     }
     return out, nil
 }
+
+func (c *Client) ListParticipants(ctx context.Context) ([]models.Participant, error) {
+    t, err := c.table(ctx, SheetParticipants)
+    if err != nil {
+        return nil, err
+    }
+    out := []models.Participant{}
+    for _, r := range t.recs {
+        p := participantFrom(r)
+        if p.TgID == 0 {
+            continue
+        }
+        out = append(out, p)
+    }
+    return out, nil
+}
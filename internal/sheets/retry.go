@@ -0,0 +1,105 @@
+package sheets
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "net"
+    "net/http"
+    "time"
+
+    "google.golang.org/api/googleapi"
+
+    "karting-bot/internal/store"
+)
+
+// call runs fn with a per-call timeout derived from ctx and retries retryable
+// Sheets errors with exponential backoff and jitter. Non-idempotent calls
+// (appends) are retried only on 429 and 503, which are refused before any
+// write; after a timeout or another server error the row may have been written.
+// When retries run out, or the next one would come after the deadline of ctx,
+// the error wraps store.ErrUnavailable.
+func (c *Client) call(ctx context.Context, idempotent bool, fn func(ctx context.Context) error) error {
+    delay := c.opts.RetryBaseDelay
+    var err error
+    for attempt := 0; ; attempt++ {
+        callCtx, cancel := ctx, context.CancelFunc(func() {})
+        if c.opts.CallTimeout > 0 {
+            callCtx, cancel = context.WithTimeout(ctx, c.opts.CallTimeout)
+        }
+        err = fn(callCtx)
+        cancel()
+        if err == nil {
+            return nil
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if !retryable(err, idempotent) {
+            return err
+        }
+        if attempt >= c.opts.MaxRetries {
+            break
+        }
+
+        // full jitter: sleep a random duration in [delay/2, delay)
+        sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+        if d := retryAfter(err); d > sleep {
+            sleep = d
+            if sleep > c.opts.RetryMaxDelay {
+                sleep = c.opts.RetryMaxDelay
+            }
+        }
+        // a retry after the deadline of ctx can't succeed: give up now
+        if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= sleep {
+            break
+        }
+        t := time.NewTimer(sleep)
+        select {
+        case <-ctx.Done():
+            t.Stop()
+            return ctx.Err()
+        case <-t.C:
+        }
+        delay *= 2
+        if delay > c.opts.RetryMaxDelay {
+            delay = c.opts.RetryMaxDelay
+        }
+    }
+    return fmt.Errorf("%w: %v", store.ErrUnavailable, err)
+}
+
+func retryable(err error, idempotent bool) bool {
+    var apiErr *googleapi.Error
+    if errors.As(err, &apiErr) {
+        switch apiErr.Code {
+        case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+            return true
+        case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+            return idempotent
+        }
+        return false
+    }
+    if !idempotent {
+        return false
+    }
+    if errors.Is(err, context.DeadlineExceeded) {
+        return true
+    }
+    var netErr net.Error
+    return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryAfter honours the Retry-After header Google sends with quota errors.
+func retryAfter(err error) time.Duration {
+    var apiErr *googleapi.Error
+    if !errors.As(err, &apiErr) || apiErr.Header == nil {
+        return 0
+    }
+    var secs int
+    if _, err := fmt.Sscan(apiErr.Header.Get("Retry-After"), &secs); err != nil {
+        return 0
+    }
+    return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,65 @@
+package sheets
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+
+    "google.golang.org/api/googleapi"
+
+    "karting-bot/internal/store"
+)
+
+func TestRetryable(t *testing.T) {
+    cases := []struct {
+        err        error
+        idempotent bool
+        want       bool
+    }{
+        {&googleapi.Error{Code: http.StatusTooManyRequests}, false, true},
+        {&googleapi.Error{Code: http.StatusServiceUnavailable}, false, true},
+        // the append may have gone through before the error
+        {&googleapi.Error{Code: http.StatusInternalServerError}, false, false},
+        {&googleapi.Error{Code: http.StatusGatewayTimeout}, false, false},
+        {context.DeadlineExceeded, false, false},
+        {&googleapi.Error{Code: http.StatusInternalServerError}, true, true},
+        {&googleapi.Error{Code: http.StatusBadGateway}, true, true},
+        {context.DeadlineExceeded, true, true},
+        {&googleapi.Error{Code: http.StatusBadRequest}, true, false},
+    }
+    for _, c := range cases {
+        if got := retryable(c.err, c.idempotent); got != c.want {
+            t.Errorf("retryable(%v, idempotent=%v) = %v, want %v", c.err, c.idempotent, got, c.want)
+        }
+    }
+}
+
+// A Retry-After of an hour waits no longer than RetryMaxDelay, and not past
+// the deadline of the caller.
+func TestCallCapsRetryAfter(t *testing.T) {
+    quota := func(ctx context.Context) error {
+        return &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"3600"}}}
+    }
+
+    c := &Client{opts: Options{RetryBaseDelay: time.Millisecond, RetryMaxDelay: 10 * time.Millisecond, MaxRetries: 2}}
+    start := time.Now()
+    if err := c.call(context.Background(), true, quota); !errors.Is(err, store.ErrUnavailable) {
+        t.Errorf("err = %v, want ErrUnavailable", err)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("retries took %v, want about 2 x RetryMaxDelay", d)
+    }
+
+    c.opts.RetryMaxDelay = time.Hour
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    defer cancel()
+    start = time.Now()
+    if err := c.call(ctx, true, quota); !errors.Is(err, store.ErrUnavailable) {
+        t.Errorf("err = %v, want ErrUnavailable", err)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("call took %v, want it to give up before the deadline", d)
+    }
+}
@@ -0,0 +1,147 @@
+package sheets
+
+import (
+    "context"
+    "fmt"
+    "strings"
+
+    sheetsv4 "google.golang.org/api/sheets/v4"
+)
+
+// Required headers of every tab (see README, "Схема Google Sheets").
+// Rows are mapped by header name, so organisers may reorder columns
+// or add their own ones next to these.
+var schema = map[string][]string{
+    SheetParticipants:  {"tg_id", "first_name", "last_name", "nick", "team_name", "created_at"},
+    SheetTeams:         {"team_id", "team_name", "created_at"},
+    SheetStages:        {"stage_id", "title", "date", "time", "place", "address", "reg_open", "price", "status", "capacity", "team_limit", "pay_deadline"},
+    SheetRegistrations: {"stage_id", "tg_id", "team_name", "role", "pay_status", "created_at", "refund"},
+    SheetResults:       {"stage_id", "tg_id", "best_time", "position", "points"},
+    SheetPhotos:        {"stage_id", "url"},
+}
+
+// sheetOrder is the order tabs are checked in, so errors are reported deterministically.
+var sheetOrder = []string{SheetParticipants, SheetTeams, SheetStages, SheetRegistrations, SheetResults, SheetPhotos}
+
+// columns maps a normalized header name to its 0-based column index.
+type columns map[string]int
+
+func normalizeHeader(h string) string {
+    return strings.ToLower(strings.TrimSpace(h))
+}
+
+func parseHeader(row []interface{}) columns {
+    cols := columns{}
+    for i, v := range row {
+        h := normalizeHeader(fmt.Sprint(v))
+        if h == "" {
+            continue
+        }
+        if _, dup := cols[h]; !dup {
+            cols[h] = i
+        }
+    }
+    return cols
+}
+
+// LoadColumns reads the header row of every tab and fails if a required header is missing.
+func (c *Client) LoadColumns(ctx context.Context) error {
+    loaded := map[string]columns{}
+    for _, sheet := range sheetOrder {
+        header, err := c.readHeader(ctx, sheet)
+        if err != nil {
+            return err
+        }
+        cols := parseHeader(header)
+        missing := []string{}
+        for _, h := range schema[sheet] {
+            if _, ok := cols[h]; !ok {
+                missing = append(missing, h)
+            }
+        }
+        if len(missing) > 0 {
+            return fmt.Errorf("sheet %s: missing columns: %s", sheet, strings.Join(missing, ", "))
+        }
+        loaded[sheet] = cols
+    }
+    c.mu.Lock()
+    c.cols = loaded
+    c.mu.Unlock()
+    return nil
+}
+
+func (c *Client) readHeader(ctx context.Context, sheet string) ([]interface{}, error) {
+    var resp *sheetsv4.ValueRange
+    err := c.call(ctx, true, func(ctx context.Context) (err error) {
+        resp, err = c.srv.Spreadsheets.Values.Get(c.spreadsheetID, sheet+"!1:1").Context(ctx).Do()
+        return err
+    })
+    if err != nil {
+        return nil, fmt.Errorf("read %s header: %w", sheet, err)
+    }
+    if len(resp.Values) == 0 {
+        return nil, nil
+    }
+    return resp.Values[0], nil
+}
+
+func (c *Client) columns(sheet string) columns {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.cols[sheet]
+}
+
+// record is a data row of a tab together with its header mapping.
+type record struct {
+    num  int // 1-based row number in the sheet
+    row  []interface{}
+    cols columns
+}
+
+func (r record) get(col string) string {
+    idx, ok := r.cols[col]
+    if !ok {
+        return ""
+    }
+    return get(r.row, idx)
+}
+
+// makeRow lays out values by header positions; unknown columns are left empty.
+func (c *Client) makeRow(sheet string, values map[string]interface{}) []interface{} {
+    cols := c.columns(sheet)
+    width := 0
+    for _, idx := range cols {
+        if idx+1 > width {
+            width = idx + 1
+        }
+    }
+    row := make([]interface{}, width)
+    for i := range row {
+        row[i] = ""
+    }
+    for col, v := range values {
+        if idx, ok := cols[col]; ok {
+            row[idx] = v
+        }
+    }
+    return row
+}
+
+// cellA1 returns the A1 address of col in the given 1-based row.
+func (c *Client) cellA1(sheet, col string, rowNum int) (string, error) {
+    idx, ok := c.columns(sheet)[col]
+    if !ok {
+        return "", fmt.Errorf("sheet %s: unknown column %s", sheet, col)
+    }
+    return fmt.Sprintf("%s%d", columnLetter(idx), rowNum), nil
+}
+
+// columnLetter converts a 0-based column index to A, B, ..., Z, AA, AB, ...
+func columnLetter(idx int) string {
+    s := ""
+    for idx >= 0 {
+        s = string(rune('A'+idx%26)) + s
+        idx = idx/26 - 1
+    }
+    return s
+}
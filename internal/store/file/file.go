@@ -0,0 +1,28 @@
+package file
+
+import (
+	"karting-bot/internal/persist"
+	"karting-bot/internal/store/memory"
+)
+
+// New opens a file-backed store: data lives in memory and a JSON snapshot
+// is written to path after every change.
+func New(path string) (*memory.Store, error) {
+	d, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	return memory.NewWithData(d, func(d memory.Data) error {
+		return save(path, d)
+	}), nil
+}
+
+func load(path string) (memory.Data, error) {
+	var d memory.Data
+	err := persist.LoadJSON(path, &d)
+	return d, err
+}
+
+func save(path string, d memory.Data) error {
+	return persist.SaveJSON(path, d)
+}
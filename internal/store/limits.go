@@ -0,0 +1,154 @@
+package store
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"karting-bot/internal/models"
+)
+
+// Limits of a stage. A team races at most TeamMain pilots as main; the rest
+// of the team is its reserve. Capacity is the number of karts: when all of
+// them are taken by main pilots, newcomers go to the waitlist of the stage.
+type Limits struct {
+	TeamMain int
+	Capacity int // 0: no limit
+}
+
+// Latest drops the registrations replaced by a later one of the same pilot
+// on the same stage. A pilot who registers again after cancelling gets a
+// new registration; the cancelled one stays in the store as history.
+func Latest(regs []models.Registration) []models.Registration {
+	last := map[string]int{}
+	for i, r := range regs {
+		last[regKey(r.StageID, r.TgID)] = i
+	}
+	out := make([]models.Registration, 0, len(last))
+	for i, r := range regs {
+		if last[regKey(r.StageID, r.TgID)] == i {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func regKey(stageID string, tgID int64) string {
+	return stageID + "/" + strconv.FormatInt(tgID, 10)
+}
+
+// PickRole is the role of a new registration of team among regs.
+func PickRole(regs []models.Registration, team string, lim Limits) string {
+	if CountMain(regs, team) >= lim.TeamMain {
+		return "reserve"
+	}
+	if StageFull(regs, lim) {
+		return "waitlist"
+	}
+	return "main"
+}
+
+// StageFull tells whether every kart of the stage is taken, see HoldsPlace.
+func StageFull(regs []models.Registration, lim Limits) bool {
+	if lim.Capacity <= 0 {
+		return false
+	}
+	return CountPlaces(regs) >= lim.Capacity
+}
+
+// CountPlaces counts the karts taken on the stage, see HoldsPlace.
+func CountPlaces(regs []models.Registration) int {
+	cnt := 0
+	for _, r := range regs {
+		if HoldsPlace(r) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// CountMain counts main pilots of team among regs, with the places offered
+// to the team's pilots from the waitlist. Cancelled registrations don't hold
+// a place.
+func CountMain(regs []models.Registration, team string) int {
+	cnt := 0
+	for _, r := range regs {
+		if HoldsPlace(r) && sameTeam(r.TeamName, team) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// HoldsPlace tells whether r takes a kart: a main pilot, or a waitlisted
+// pilot the place is offered to.
+func HoldsPlace(r models.Registration) bool {
+	return (r.Role == "main" || r.Role == "offered") && r.PayStatus != "cancelled"
+}
+
+func sameTeam(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// Queue is the active registrations with role, earliest created_at first;
+// registrations made in the same second keep their order.
+func Queue(regs []models.Registration, role string) []models.Registration {
+	type item struct {
+		r  models.Registration
+		at time.Time
+	}
+	items := []item{}
+	for _, r := range regs {
+		if r.Role != role || r.PayStatus == "cancelled" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, r.CreatedAt)
+		if err != nil {
+			// unreadable dates go last
+			at = time.Unix(1<<40, 0)
+		}
+		items = append(items, item{r, at})
+	}
+	sort.SliceStable(items, func(i, k int) bool { return items[i].at.Before(items[k].at) })
+	out := make([]models.Registration, len(items))
+	for i, it := range items {
+		out[i] = it.r
+	}
+	return out
+}
+
+// NextReserve is the reserve of team among regs who registered first.
+func NextReserve(regs []models.Registration, team string) (models.Registration, bool) {
+	for _, r := range Queue(regs, "reserve") {
+		if sameTeam(r.TeamName, team) {
+			return r, true
+		}
+	}
+	return models.Registration{}, false
+}
+
+// NextWaitlisted is the first pilot of the waitlist whose team has room for
+// one more main pilot, when the stage has a free kart.
+func NextWaitlisted(regs []models.Registration, lim Limits) (models.Registration, bool) {
+	if StageFull(regs, lim) {
+		return models.Registration{}, false
+	}
+	for _, r := range Queue(regs, "waitlist") {
+		if CountMain(regs, r.TeamName) < lim.TeamMain {
+			return r, true
+		}
+	}
+	return models.Registration{}, false
+}
+
+// WaitlistPosition is the place of tgID on the waitlist, from 1; 0 when the
+// pilot is not on it.
+func WaitlistPosition(regs []models.Registration, tgID int64) int {
+	for i, r := range Queue(regs, "waitlist") {
+		if r.TgID == tgID {
+			return i + 1
+		}
+	}
+	return 0
+}
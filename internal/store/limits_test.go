@@ -0,0 +1,81 @@
+package store
+
+import (
+	"testing"
+
+	"karting-bot/internal/models"
+)
+
+func TestPickRole(t *testing.T) {
+	regs := []models.Registration{
+		{TgID: 1, TeamName: "Молния", Role: "main"},
+		{TgID: 2, TeamName: "Молния", Role: "main"},
+		{TgID: 3, TeamName: "Ракета", Role: "main"},
+		{TgID: 4, TeamName: "Ракета", Role: "main", PayStatus: "cancelled"},
+	}
+	cases := []struct {
+		team string
+		lim  Limits
+		want string
+	}{
+		{"молния", Limits{TeamMain: 2}, "reserve"},
+		{"Ракета", Limits{TeamMain: 2}, "main"},
+		{"Ракета", Limits{TeamMain: 2, Capacity: 3}, "waitlist"},
+		{"Ракета", Limits{TeamMain: 2, Capacity: 4}, "main"},
+		// a full team keeps its reserve even on a full stage
+		{"Молния", Limits{TeamMain: 2, Capacity: 3}, "reserve"},
+	}
+	for _, c := range cases {
+		if got := PickRole(regs, c.team, c.lim); got != c.want {
+			t.Errorf("PickRole(%s, %+v) = %s, want %s", c.team, c.lim, got, c.want)
+		}
+	}
+}
+
+func TestWaitlistPosition(t *testing.T) {
+	regs := []models.Registration{
+		{TgID: 1, Role: "waitlist", CreatedAt: "2026-05-03T10:00:00+03:00"},
+		{TgID: 2, Role: "waitlist", CreatedAt: "2026-05-01T10:00:00+03:00"},
+		{TgID: 3, Role: "waitlist", CreatedAt: "2026-05-02T10:00:00+03:00", PayStatus: "cancelled"},
+		{TgID: 4, Role: "waitlist", CreatedAt: "2026-05-02T12:00:00+03:00"},
+		{TgID: 5, Role: "main"},
+	}
+	want := map[int64]int{1: 3, 2: 1, 3: 0, 4: 2, 5: 0}
+	for id, pos := range want {
+		if got := WaitlistPosition(regs, id); got != pos {
+			t.Errorf("position of %d = %d, want %d", id, got, pos)
+		}
+	}
+}
+
+func TestNextWaitlisted(t *testing.T) {
+	regs := []models.Registration{
+		{TgID: 1, TeamName: "Молния", Role: "main"},
+		{TgID: 2, TeamName: "Ракета", Role: "offered"},
+		{TgID: 3, TeamName: "Молния", Role: "waitlist", CreatedAt: "2026-05-01T10:00:00+03:00"},
+		{TgID: 4, TeamName: "Комета", Role: "waitlist", CreatedAt: "2026-05-02T10:00:00+03:00"},
+	}
+	if _, ok := NextWaitlisted(regs, Limits{TeamMain: 1, Capacity: 2}); ok {
+		t.Error("an offered place must count against the capacity")
+	}
+	// Молния has its main pilot already, so pilot 3 is skipped
+	if r, ok := NextWaitlisted(regs, Limits{TeamMain: 1, Capacity: 3}); !ok || r.TgID != 4 {
+		t.Errorf("next = %d, %v; want pilot 4", r.TgID, ok)
+	}
+	if r, ok := NextWaitlisted(regs, Limits{TeamMain: 2, Capacity: 3}); !ok || r.TgID != 3 {
+		t.Errorf("next = %d, %v; want pilot 3", r.TgID, ok)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	regs := []models.Registration{
+		{StageID: "1", TgID: 1, PayStatus: "cancelled"},
+		{StageID: "1", TgID: 2, PayStatus: "paid"},
+		{StageID: "2", TgID: 1, PayStatus: "paid"},
+		{StageID: "1", TgID: 1, PayStatus: "unpaid"},
+	}
+	got := Latest(regs)
+	if len(got) != 3 || got[0].TgID != 2 || got[1].StageID != "2" || got[2].PayStatus != "unpaid" {
+		t.Errorf("Latest = %+v, want pilot 2, pilot 1 on stage 2 and the new registration of pilot 1", got)
+	}
+}
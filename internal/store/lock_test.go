@@ -0,0 +1,34 @@
+package store
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyedMutexSerializesPerKey(t *testing.T) {
+	var km KeyedMutex
+	keys := []string{"1", "2", "3"}
+	counters := make([]int, len(keys))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		i := i % len(keys)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := km.Lock(keys[i])
+			defer unlock()
+			counters[i]++ // -race reports this if one key is not serialized
+		}()
+	}
+	wg.Wait()
+
+	for i, n := range counters {
+		if n != 100 {
+			t.Fatalf("key %s: counter = %d, want 100", keys[i], n)
+		}
+	}
+	if len(km.locks) != 0 {
+		t.Fatalf("locks left after unlock: %d", len(km.locks))
+	}
+}
@@ -0,0 +1,412 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/store"
+	"karting-bot/internal/util"
+)
+
+// Data is the full content of the store. It is also the on-disk format of the file store.
+type Data struct {
+	Participants  []models.Participant
+	Teams         []models.Team
+	Stages        []models.Stage
+	Registrations []models.Registration
+	Results       []models.Result
+	Photos        []models.Photo
+}
+
+// Store keeps everything in memory. Useful for local runs and tests.
+type Store struct {
+	mu   sync.RWMutex
+	data Data
+
+	// onChange is called with the lock held after every successful mutation.
+	onChange func(Data) error
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New() *Store {
+	return &Store{}
+}
+
+// NewWithData starts from d and calls onChange after every mutation (nil is allowed).
+func NewWithData(d Data, onChange func(Data) error) *Store {
+	for i := range d.Stages {
+		if d.Stages[i].Status == "" {
+			// saved before stages had a status
+			d.Stages[i].Status = models.LegacyStageStatus(d.Stages[i].RegOpen)
+		}
+	}
+	return &Store{data: d, onChange: onChange}
+}
+
+func (s *Store) read(fn func(d *Data)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn(&s.data)
+}
+
+func (s *Store) mutate(fn func(d *Data) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := fn(&s.data); err != nil {
+		return err
+	}
+	if s.onChange != nil {
+		return s.onChange(s.data)
+	}
+	return nil
+}
+
+// ---------- Participants ----------
+
+func (s *Store) GetParticipant(ctx context.Context, tgID int64) (*models.Participant, error) {
+	var out *models.Participant
+	s.read(func(d *Data) {
+		for _, p := range d.Participants {
+			if p.TgID == tgID {
+				pp := p
+				out = &pp
+				return
+			}
+		}
+	})
+	return out, nil
+}
+
+func (s *Store) CreateParticipant(ctx context.Context, p models.Participant) error {
+	return s.mutate(func(d *Data) error {
+		d.Participants = append(d.Participants, p)
+		return nil
+	})
+}
+
+func (s *Store) UpdateParticipantTeam(ctx context.Context, tgID int64, teamName string) error {
+	return s.mutate(func(d *Data) error {
+		for i := range d.Participants {
+			if d.Participants[i].TgID == tgID {
+				d.Participants[i].TeamName = teamName
+				return nil
+			}
+		}
+		return fmt.Errorf("participant: %w", store.ErrNotFound)
+	})
+}
+
+func (s *Store) ListParticipantIDs(ctx context.Context) ([]int64, error) {
+	out := []int64{}
+	s.read(func(d *Data) {
+		for _, p := range d.Participants {
+			out = append(out, p.TgID)
+		}
+	})
+	return out, nil
+}
+
+func (s *Store) ListParticipants(ctx context.Context) ([]models.Participant, error) {
+	out := []models.Participant{}
+	s.read(func(d *Data) {
+		out = append(out, d.Participants...)
+	})
+	return out, nil
+}
+
+// ---------- Teams ----------
+
+func (s *Store) ListTeams(ctx context.Context) ([]models.Team, error) {
+	teams := []models.Team{}
+	s.read(func(d *Data) {
+		for _, t := range d.Teams {
+			if strings.TrimSpace(t.TeamName) != "" {
+				teams = append(teams, t)
+			}
+		}
+	})
+	return teams, nil
+}
+
+func (s *Store) GetTeam(ctx context.Context, teamID string) (*models.Team, error) {
+	var out *models.Team
+	s.read(func(d *Data) {
+		for _, t := range d.Teams {
+			if t.TeamID == teamID {
+				tt := t
+				out = &tt
+				return
+			}
+		}
+	})
+	return out, nil
+}
+
+func (s *Store) CreateTeam(ctx context.Context, name string) (models.Team, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return models.Team{}, fmt.Errorf("team name empty")
+	}
+	t := models.Team{TeamName: name, CreatedAt: util.NowISO()}
+	err := s.mutate(func(d *Data) error {
+		if _, ok := store.FindTeamByName(d.Teams, name); ok {
+			return store.ErrTeamExists
+		}
+		taken := map[string]bool{}
+		for _, ex := range d.Teams {
+			taken[ex.TeamID] = true
+		}
+		t.TeamID = store.NewTeamID(name, taken)
+		d.Teams = append(d.Teams, t)
+		return nil
+	})
+	if err != nil {
+		return models.Team{}, err
+	}
+	return t, nil
+}
+
+// ---------- Stages ----------
+
+func (s *Store) ListStages(ctx context.Context, all bool) ([]models.Stage, error) {
+	stages := []models.Stage{}
+	s.read(func(d *Data) {
+		for _, st := range d.Stages {
+			if !all && st.Status != models.StageRegOpen {
+				continue
+			}
+			stages = append(stages, st)
+		}
+	})
+	return stages, nil
+}
+
+func (s *Store) GetStage(ctx context.Context, stageID string) (*models.Stage, error) {
+	var out *models.Stage
+	s.read(func(d *Data) {
+		for _, st := range d.Stages {
+			if st.StageID == stageID {
+				ss := st
+				out = &ss
+				return
+			}
+		}
+	})
+	return out, nil
+}
+
+func (s *Store) CreateStage(ctx context.Context, st models.Stage) error {
+	if st.Status == "" {
+		st.Status = models.LegacyStageStatus(st.RegOpen)
+	}
+	return s.mutate(func(d *Data) error {
+		d.Stages = append(d.Stages, st)
+		return nil
+	})
+}
+
+func (s *Store) UpdateStage(ctx context.Context, st models.Stage) error {
+	return s.mutate(func(d *Data) error {
+		for i := range d.Stages {
+			if d.Stages[i].StageID == st.StageID {
+				d.Stages[i] = st
+				return nil
+			}
+		}
+		return fmt.Errorf("stage: %w", store.ErrNotFound)
+	})
+}
+
+// ---------- Registrations ----------
+
+func (s *Store) ListRegistrationsForStage(ctx context.Context, stageID string) ([]models.Registration, error) {
+	regs := []models.Registration{}
+	s.read(func(d *Data) {
+		for _, r := range d.Registrations {
+			if r.StageID == stageID {
+				regs = append(regs, r)
+			}
+		}
+	})
+	return store.Latest(regs), nil
+}
+
+func (s *Store) ListRegistrationsForPilot(ctx context.Context, tgID int64) ([]models.Registration, error) {
+	regs := []models.Registration{}
+	s.read(func(d *Data) {
+		for _, r := range d.Registrations {
+			if r.TgID == tgID {
+				regs = append(regs, r)
+			}
+		}
+	})
+	return store.Latest(regs), nil
+}
+
+func (s *Store) HasRegistration(ctx context.Context, stageID string, tgID int64) (bool, error) {
+	has := false
+	s.read(func(d *Data) {
+		for _, r := range d.Registrations {
+			if r.StageID == stageID && r.TgID == tgID {
+				has = true
+				return
+			}
+		}
+	})
+	return has, nil
+}
+
+func (s *Store) CreateRegistration(ctx context.Context, r models.Registration) error {
+	return s.mutate(func(d *Data) error {
+		d.Registrations = append(d.Registrations, r)
+		return nil
+	})
+}
+
+func (s *Store) RegisterForStage(ctx context.Context, r models.Registration, lim store.Limits) (models.Registration, error) {
+	err := s.mutate(func(d *Data) error {
+		if i := d.latest(r.StageID, r.TgID); i >= 0 && d.Registrations[i].PayStatus != "cancelled" {
+			return store.ErrAlreadyRegistered
+		}
+		r.Role = store.PickRole(d.forStage(r.StageID), r.TeamName, lim)
+		d.Registrations = append(d.Registrations, r)
+		return nil
+	})
+	return r, err
+}
+
+func (s *Store) PromoteReserve(ctx context.Context, stageID, teamName string, lim store.Limits) (*models.Registration, error) {
+	var promoted *models.Registration
+	err := s.mutate(func(d *Data) error {
+		stageRegs := d.forStage(stageID)
+		if store.CountMain(stageRegs, teamName) >= lim.TeamMain || store.StageFull(stageRegs, lim) {
+			return nil
+		}
+		next, ok := store.NextReserve(stageRegs, teamName)
+		if !ok {
+			return nil
+		}
+		i := d.latest(stageID, next.TgID)
+		d.Registrations[i].Role = "main"
+		r := d.Registrations[i]
+		promoted = &r
+		return nil
+	})
+	return promoted, err
+}
+
+func (s *Store) OfferWaitlist(ctx context.Context, stageID string, lim store.Limits) (*models.Registration, error) {
+	var offered *models.Registration
+	err := s.mutate(func(d *Data) error {
+		next, ok := store.NextWaitlisted(d.forStage(stageID), lim)
+		if !ok {
+			return nil
+		}
+		i := d.latest(stageID, next.TgID)
+		d.Registrations[i].Role = "offered"
+		r := d.Registrations[i]
+		offered = &r
+		return nil
+	})
+	return offered, err
+}
+
+func (s *Store) UpdatePayStatus(ctx context.Context, stageID string, tgID int64, payStatus string) error {
+	return s.updateRegistration(stageID, tgID, func(r *models.Registration) { r.PayStatus = payStatus })
+}
+
+func (s *Store) UpdateRole(ctx context.Context, stageID string, tgID int64, role string) error {
+	return s.updateRegistration(stageID, tgID, func(r *models.Registration) { r.Role = role })
+}
+
+func (s *Store) UpdateRefund(ctx context.Context, stageID string, tgID int64, refund string) error {
+	return s.updateRegistration(stageID, tgID, func(r *models.Registration) { r.Refund = refund })
+}
+
+func (s *Store) updateRegistration(stageID string, tgID int64, fn func(r *models.Registration)) error {
+	return s.mutate(func(d *Data) error {
+		i := d.latest(stageID, tgID)
+		if i < 0 {
+			return fmt.Errorf("registration: %w", store.ErrNotFound)
+		}
+		fn(&d.Registrations[i])
+		return nil
+	})
+}
+
+// forStage is the current registrations of stageID.
+func (d *Data) forStage(stageID string) []models.Registration {
+	regs := []models.Registration{}
+	for _, r := range d.Registrations {
+		if r.StageID == stageID {
+			regs = append(regs, r)
+		}
+	}
+	return store.Latest(regs)
+}
+
+// latest is the index of the current registration of tgID on stageID, or -1.
+func (d *Data) latest(stageID string, tgID int64) int {
+	for i := len(d.Registrations) - 1; i >= 0; i-- {
+		if d.Registrations[i].StageID == stageID && d.Registrations[i].TgID == tgID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Store) CountMainForTeam(ctx context.Context, stageID, teamName string) (int, error) {
+	regs, err := s.ListRegistrationsForStage(ctx, stageID)
+	if err != nil {
+		return 0, err
+	}
+	return store.CountMain(regs, teamName), nil
+}
+
+// ---------- Results & Photos ----------
+
+func (s *Store) GetResult(ctx context.Context, stageID string, tgID int64) (*models.Result, error) {
+	var out *models.Result
+	s.read(func(d *Data) {
+		for _, r := range d.Results {
+			if r.StageID == stageID && r.TgID == tgID {
+				rr := r
+				out = &rr
+				return
+			}
+		}
+	})
+	return out, nil
+}
+
+func (s *Store) SumPointsForUser(ctx context.Context, tgID int64) (int, error) {
+	sum := 0
+	s.read(func(d *Data) {
+		for _, r := range d.Results {
+			if r.TgID == tgID {
+				p, _ := strconv.Atoi(strings.TrimSpace(r.Points))
+				sum += p
+			}
+		}
+	})
+	return sum, nil
+}
+
+func (s *Store) GetPhoto(ctx context.Context, stageID string) (*models.Photo, error) {
+	var out *models.Photo
+	s.read(func(d *Data) {
+		for _, p := range d.Photos {
+			if p.StageID == stageID {
+				pp := p
+				out = &pp
+				return
+			}
+		}
+	})
+	return out, nil
+}
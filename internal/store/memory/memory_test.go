@@ -0,0 +1,208 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/store"
+)
+
+func TestRegisterForStageConcurrentTeamLimit(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	const pilots = 10
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < pilots; i++ {
+		wg.Add(1)
+		go func(tgID int64) {
+			defer wg.Done()
+			<-start
+			_, err := s.RegisterForStage(ctx, models.Registration{StageID: "1", TgID: tgID, TeamName: "Молния"}, store.Limits{TeamMain: 3})
+			if err != nil {
+				t.Errorf("register %d: %v", tgID, err)
+			}
+		}(int64(i + 1))
+	}
+	close(start)
+	wg.Wait()
+
+	regs, _ := s.ListRegistrationsForStage(ctx, "1")
+	if len(regs) != pilots {
+		t.Fatalf("registrations = %d, want %d", len(regs), pilots)
+	}
+	if got := store.CountMain(regs, "молния"); got != 3 {
+		t.Fatalf("main pilots = %d, want 3", got)
+	}
+}
+
+func TestRegisterForStageConcurrentDoubleTap(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	const taps = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok, dup := 0, 0
+	start := make(chan struct{})
+	for i := 0; i < taps; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := s.RegisterForStage(ctx, models.Registration{StageID: "1", TgID: 42, TeamName: "Ракета"}, store.Limits{TeamMain: 3})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				ok++
+			case errors.Is(err, store.ErrAlreadyRegistered):
+				dup++
+			default:
+				t.Errorf("register: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if ok != 1 || dup != taps-1 {
+		t.Fatalf("ok = %d, duplicates = %d, want 1 and %d", ok, dup, taps-1)
+	}
+	regs, _ := s.ListRegistrationsForStage(ctx, "1")
+	if len(regs) != 1 {
+		t.Fatalf("registrations = %d, want 1", len(regs))
+	}
+}
+
+func TestPromoteReserve(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+	for _, r := range []models.Registration{
+		{StageID: "1", TgID: 1, TeamName: "Молния", Role: "main", PayStatus: "paid"},
+		{StageID: "1", TgID: 2, TeamName: "Молния", Role: "main", PayStatus: "unpaid"},
+		{StageID: "1", TgID: 3, TeamName: "Молния", Role: "reserve", CreatedAt: "2026-05-02T10:00:00+03:00"},
+		{StageID: "1", TgID: 4, TeamName: "молния", Role: "reserve", CreatedAt: "2026-05-01T10:00:00+03:00"},
+		{StageID: "1", TgID: 5, TeamName: "Ракета", Role: "reserve", CreatedAt: "2026-04-01T10:00:00+03:00"},
+	} {
+		if err := s.CreateRegistration(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the team is full
+	if p, err := s.PromoteReserve(ctx, "1", "Молния", store.Limits{TeamMain: 2}); err != nil || p != nil {
+		t.Fatalf("promoted %+v, %v; want nothing", p, err)
+	}
+
+	if err := s.UpdatePayStatus(ctx, "1", 2, "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.PromoteReserve(ctx, "1", "Молния", store.Limits{TeamMain: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.TgID != 4 || p.Role != "main" {
+		t.Fatalf("promoted %+v, want pilot 4 as main", p)
+	}
+	regs, _ := s.ListRegistrationsForStage(ctx, "1")
+	if got := store.CountMain(regs, "Молния"); got != 2 {
+		t.Fatalf("main pilots = %d, want 2", got)
+	}
+
+	// the freed place is taken
+	if p, err := s.PromoteReserve(ctx, "1", "Молния", store.Limits{TeamMain: 2}); err != nil || p != nil {
+		t.Fatalf("promoted %+v, %v; want nothing", p, err)
+	}
+}
+
+func TestRegisterAgainAfterCancel(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+	r := models.Registration{StageID: "1", TgID: 1, TeamName: "Молния", PayStatus: "unpaid"}
+	if _, err := s.RegisterForStage(ctx, r, store.Limits{TeamMain: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RegisterForStage(ctx, models.Registration{StageID: "1", TgID: 2, TeamName: "Молния", PayStatus: "unpaid"}, store.Limits{TeamMain: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdatePayStatus(ctx, "1", 1, "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.RegisterForStage(ctx, r, store.Limits{TeamMain: 1})
+	if err != nil {
+		t.Fatalf("register again: %v", err)
+	}
+	// nobody was promoted into the freed place, so pilot 1 gets it again
+	if got.Role != "main" {
+		t.Errorf("role = %q, want main", got.Role)
+	}
+	regs, _ := s.ListRegistrationsForPilot(ctx, 1)
+	if len(regs) != 1 || regs[0].PayStatus != "unpaid" {
+		t.Fatalf("registrations of pilot 1 = %+v, want one unpaid", regs)
+	}
+	// the cancelled registration is kept
+	all := 0
+	s.read(func(d *Data) {
+		for _, r := range d.Registrations {
+			if r.TgID == 1 {
+				all++
+			}
+		}
+	})
+	if all != 2 {
+		t.Errorf("pilot 1 has %d registrations stored, want 2", all)
+	}
+	if _, err := s.RegisterForStage(ctx, r, store.Limits{TeamMain: 1}); !errors.Is(err, store.ErrAlreadyRegistered) {
+		t.Fatalf("third registration: %v, want ErrAlreadyRegistered", err)
+	}
+}
+
+func TestOfferWaitlist(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+	lim := store.Limits{TeamMain: 1, Capacity: 2}
+	for _, r := range []models.Registration{
+		{StageID: "1", TgID: 1, TeamName: "Молния", Role: "main"},
+		{StageID: "1", TgID: 2, TeamName: "Ракета", Role: "main"},
+		{StageID: "1", TgID: 3, TeamName: "Молния", Role: "waitlist", CreatedAt: "2026-05-01T10:00:00+03:00"},
+		{StageID: "1", TgID: 4, TeamName: "Комета", Role: "waitlist", CreatedAt: "2026-05-02T10:00:00+03:00"},
+	} {
+		if err := s.CreateRegistration(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the stage is full
+	if r, err := s.OfferWaitlist(ctx, "1", lim); err != nil || r != nil {
+		t.Fatalf("offered %+v, %v; want nothing", r, err)
+	}
+
+	if err := s.UpdatePayStatus(ctx, "1", 1, "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.OfferWaitlist(ctx, "1", lim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pilot 1 dropped out, so their team has room for pilot 3
+	if r == nil || r.TgID != 3 || r.Role != "offered" {
+		t.Fatalf("offered %+v, want pilot 3", r)
+	}
+
+	// an offered place is held until the pilot answers
+	if r, err := s.OfferWaitlist(ctx, "1", lim); err != nil || r != nil {
+		t.Fatalf("offered %+v, %v; want nothing", r, err)
+	}
+	if err := s.UpdatePayStatus(ctx, "1", 3, "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.OfferWaitlist(ctx, "1", lim); err != nil || r == nil || r.TgID != 4 {
+		t.Fatalf("offered %+v, %v; want pilot 4", r, err)
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"karting-bot/internal/models"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable means the backend kept failing after retries; the user should try again later.
+	ErrUnavailable = errors.New("storage temporarily unavailable")
+
+	ErrAlreadyRegistered = errors.New("already registered for stage")
+)
+
+// Store is the persistence layer shared by the bot and the HTTP server.
+// Implementations: Google Sheets (internal/sheets), in-memory and file-backed.
+type Store interface {
+	// Participants
+	GetParticipant(ctx context.Context, tgID int64) (*models.Participant, error)
+	CreateParticipant(ctx context.Context, p models.Participant) error
+	UpdateParticipantTeam(ctx context.Context, tgID int64, teamName string) error
+	ListParticipantIDs(ctx context.Context) ([]int64, error)
+	ListParticipants(ctx context.Context) ([]models.Participant, error)
+
+	// Teams
+	ListTeams(ctx context.Context) ([]models.Team, error)
+	GetTeam(ctx context.Context, teamID string) (*models.Team, error)
+	// CreateTeam assigns a unique team_id and fails with ErrTeamExists when
+	// a team with the same name (case-insensitive) is already there.
+	CreateTeam(ctx context.Context, name string) (models.Team, error)
+
+	// Stages
+	ListStages(ctx context.Context, all bool) ([]models.Stage, error)
+	GetStage(ctx context.Context, stageID string) (*models.Stage, error)
+	CreateStage(ctx context.Context, s models.Stage) error
+	// UpdateStage saves every field of s but StageID, which selects the stage.
+	UpdateStage(ctx context.Context, s models.Stage) error
+
+	// Registrations. A pilot has at most one current registration per
+	// stage: registrations replaced after a cancel stay in the store, but
+	// the methods below only see the latest one (see Latest).
+	ListRegistrationsForStage(ctx context.Context, stageID string) ([]models.Registration, error)
+	ListRegistrationsForPilot(ctx context.Context, tgID int64) ([]models.Registration, error)
+	HasRegistration(ctx context.Context, stageID string, tgID int64) (bool, error)
+	CreateRegistration(ctx context.Context, r models.Registration) error
+	// RegisterForStage atomically checks that the pilot is not registered yet
+	// (ErrAlreadyRegistered otherwise), picks the role with PickRole and saves
+	// the registration. After a cancelled registration the pilot gets a new
+	// one; the cancelled one is kept with its refund state.
+	RegisterForStage(ctx context.Context, r models.Registration, lim Limits) (models.Registration, error)
+	// PromoteReserve atomically moves the earliest reserve of team (see
+	// NextReserve) to main when the team has fewer than lim.TeamMain main
+	// pilots and the stage has a free kart. It returns the promoted
+	// registration, or nil when there is no free place or no reserve.
+	PromoteReserve(ctx context.Context, stageID, teamName string, lim Limits) (*models.Registration, error)
+	// OfferWaitlist atomically gives the role "offered" to the pilot picked by
+	// NextWaitlisted, which holds the free kart until the pilot answers. It
+	// returns nil when there is no free kart or nobody to offer it to.
+	OfferWaitlist(ctx context.Context, stageID string, lim Limits) (*models.Registration, error)
+	UpdatePayStatus(ctx context.Context, stageID string, tgID int64, payStatus string) error
+	UpdateRole(ctx context.Context, stageID string, tgID int64, role string) error
+	UpdateRefund(ctx context.Context, stageID string, tgID int64, refund string) error
+	CountMainForTeam(ctx context.Context, stageID, teamName string) (int, error)
+
+	// Results & Photos
+	GetResult(ctx context.Context, stageID string, tgID int64) (*models.Result, error)
+	SumPointsForUser(ctx context.Context, tgID int64) (int, error)
+	GetPhoto(ctx context.Context, stageID string) (*models.Photo, error)
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/util"
+)
+
+var ErrTeamExists = errors.New("team already exists")
+
+// NewTeamID makes a readable id from the team name (transliterated slug) and
+// adds a numeric suffix while it is taken.
+func NewTeamID(name string, taken map[string]bool) string {
+	base := util.Slug(name, "team")
+	id := base
+	for n := 2; taken[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	return id
+}
+
+// FindTeamByName looks a team up by name, ignoring case and surrounding spaces.
+func FindTeamByName(teams []models.Team, name string) (models.Team, bool) {
+	name = strings.TrimSpace(name)
+	for _, t := range teams {
+		if strings.EqualFold(strings.TrimSpace(t.TeamName), name) {
+			return t, true
+		}
+	}
+	return models.Team{}, false
+}
@@ -2,8 +2,10 @@ package tgbot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
@@ -12,39 +14,65 @@ import (
 	"karting-bot/internal/config"
 	"karting-bot/internal/models"
 	"karting-bot/internal/payments"
-	"karting-bot/internal/sheets"
+	"karting-bot/internal/scheduler"
+	"karting-bot/internal/store"
 	"karting-bot/internal/util"
 )
 
 type App struct {
 	cfg config.Config
 	bot *tgbotapi.BotAPI
-	sh  *sheets.Client
+	db  store.Store
 	pay payments.PaymentProvider
 
-	// very simple in-memory state machine for registration / admin flows
-	state map[int64]userState
+	// state machine for registration / admin flows, persisted by a StateStore
+	state *stateMap
+
+	// background broadcast jobs
+	broadcasts *broadcaster
+	// jobs to run at a set time, e.g. scheduled broadcasts
+	sched *scheduler.Scheduler
+	// automatic notifications already sent, e.g. stage reminders
+	sent *sentLog
+	// places offered to the waitlist
+	offers *offerLog
+	// serializes changes of pay_status and role per stage, see locked
+	locks store.KeyedMutex
+
+	routes map[string]callbackHandler
 }
 
-type userState struct {
-	Flow string
-	Step int
-	Data map[string]string
-}
-
-func New(cfg config.Config, sh *sheets.Client, pay payments.PaymentProvider) (*App, error) {
+func New(cfg config.Config, db store.Store, pay payments.PaymentProvider, storage Storage, sched *scheduler.Scheduler) (*App, error) {
+	state, err := newStateMap(storage.States)
+	if err != nil {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
 	b, err := tgbotapi.NewBotAPI(cfg.TelegramToken)
 	if err != nil {
 		return nil, err
 	}
 	b.Debug = false
-	return &App{
+	a := &App{
 		cfg:   cfg,
 		bot:   b,
-		sh:    sh,
+		db:    db,
 		pay:   pay,
-		state: map[int64]userState{},
-	}, nil
+		state: state,
+		sched: sched,
+	}
+	if a.broadcasts, err = newBroadcaster(a, storage.Broadcasts); err != nil {
+		return nil, fmt.Errorf("load broadcasts: %w", err)
+	}
+	if a.sent, err = newSentLog(storage.Sent); err != nil {
+		return nil, fmt.Errorf("load sent marks: %w", err)
+	}
+	if a.offers, err = newOfferLog(storage.Offers); err != nil {
+		return nil, fmt.Errorf("load offers: %w", err)
+	}
+	a.routes = a.callbackRoutes()
+	sched.Handle(jobBroadcast, a.runScheduledBroadcast)
+	sched.Handle(jobOfferExpiry, a.runOfferExpiry)
+	return a, nil
 }
 
 func (a *App) Run(ctx context.Context) error {
@@ -53,20 +81,58 @@ func (a *App) Run(ctx context.Context) error {
 
 	updates := a.bot.GetUpdatesChan(u)
 
+	// queued updates are still handled after ctx is done, so the workers get
+	// a context of their own, cancelled once they are drained
+	work, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+	d := newDispatcher(a.cfg.BotWorkers, a.handleUpdate)
+	d.start(work)
+	defer d.stop()
+	defer a.bot.StopReceivingUpdates()
+
+	a.broadcasts.start(ctx)
+	defer a.broadcasts.wait()
+	go a.sched.Run(ctx)
+	go a.runReminders(ctx)
+	go a.runPayDeadlines(ctx)
+
+	expireTick := time.NewTicker(time.Minute)
+	defer expireTick.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case upd := <-updates:
-			if upd.Message != nil {
-				if err := a.handleMessage(ctx, upd.Message); err != nil {
-					log.Printf("handle msg: %v", err)
-				}
-			} else if upd.CallbackQuery != nil {
-				if err := a.handleCallback(ctx, upd.CallbackQuery); err != nil {
-					log.Printf("handle cb: %v", err)
-				}
-			}
+			d.dispatch(ctx, upd)
+		case <-expireTick.C:
+			a.expireStates()
+		}
+	}
+}
+
+// expireStates resets flows abandoned for longer than StateTimeout and tells the users.
+func (a *App) expireStates() {
+	if a.cfg.StateTimeout <= 0 {
+		return
+	}
+	for tgID, st := range a.state.expire(a.cfg.StateTimeout) {
+		if err := a.SendText(tgID, "⌛️ Ты долго не отвечал, поэтому начатый сценарий сброшен. Начни заново: "+flowHome(st.Flow)); err != nil {
+			log.Printf("notify expired state: %v", err)
+		}
+	}
+}
+
+func (a *App) handleUpdate(ctx context.Context, upd tgbotapi.Update) {
+	if upd.Message != nil {
+		if err := a.handleMessage(ctx, upd.Message); err != nil {
+			log.Printf("handle msg: %v", err)
+			a.reportError(upd.Message.From.ID, err)
+		}
+	} else if upd.CallbackQuery != nil {
+		if err := a.handleCallback(ctx, upd.CallbackQuery); err != nil {
+			log.Printf("handle cb: %v", err)
+			a.reportError(upd.CallbackQuery.From.ID, err)
 		}
 	}
 }
@@ -77,6 +143,17 @@ func (a *App) SendText(chatID int64, text string) error {
 	return err
 }
 
+// reportError tells the user that their action did not go through when the
+// storage stayed unavailable after retries.
+func (a *App) reportError(tgID int64, err error) {
+	if !errors.Is(err, store.ErrUnavailable) {
+		return
+	}
+	if err := a.SendText(tgID, "⏳ Сервис сейчас перегружен, действие не выполнено. Попробуй ещё раз через минуту."); err != nil {
+		log.Printf("report error: %v", err)
+	}
+}
+
 func (a *App) isAdmin(tgID int64) bool {
 	return a.cfg.AdminTGIDs[tgID]
 }
@@ -88,20 +165,26 @@ func (a *App) handleMessage(ctx context.Context, m *tgbotapi.Message) error {
 	txt := strings.TrimSpace(m.Text)
 
 	if strings.HasPrefix(txt, "/start") {
-		a.state[tgID] = userState{}
+		a.state.set(tgID, UserState{})
 		return a.showStart(ctx, tgID)
 	}
+	if strings.HasPrefix(txt, "/cancel") {
+		return a.cancelFlow(tgID)
+	}
 	if strings.HasPrefix(txt, "/admin") {
 		if !a.isAdmin(tgID) {
 			return a.SendText(tgID, "Доступ запрещён.")
 		}
-		a.state[tgID] = userState{}
+		a.state.set(tgID, UserState{})
 		return a.showAdminMenu(tgID)
 	}
 
 	// flow-based input
-	st := a.state[tgID]
+	st := a.state.get(tgID)
 	if st.Flow != "" {
+		if st.Flow == "admin_broadcast" && (len(m.Photo) > 0 || m.Document != nil) {
+			return a.handleBroadcastMedia(ctx, m, st)
+		}
 		return a.handleFlowInput(ctx, tgID, txt, st)
 	}
 
@@ -109,7 +192,7 @@ func (a *App) handleMessage(ctx context.Context, m *tgbotapi.Message) error {
 	return a.showMainMenu(ctx, tgID)
 }
 
-func (a *App) handleFlowInput(ctx context.Context, tgID int64, txt string, st userState) error {
+func (a *App) handleFlowInput(ctx context.Context, tgID int64, txt string, st UserState) error {
 	switch st.Flow {
 	case "reg":
 		return a.handleRegistrationFlow(ctx, tgID, txt, st)
@@ -117,23 +200,29 @@ func (a *App) handleFlowInput(ctx context.Context, tgID int64, txt string, st us
 		return a.handleTeamCreateFlow(ctx, tgID, txt, st)
 	case "admin_create_stage":
 		return a.handleAdminCreateStageFlow(ctx, tgID, txt, st)
+	case "admin_edit_stage":
+		return a.handleAdminEditStageFlow(ctx, tgID, txt, st)
 	case "admin_broadcast":
 		return a.handleAdminBroadcastFlow(ctx, tgID, txt, st)
+	case "admin_cancel_stage":
+		return a.handleAdminCancelStageFlow(ctx, tgID, txt, st)
 	default:
-		a.state[tgID] = userState{}
+		a.state.set(tgID, UserState{})
 		return a.SendText(tgID, "Сброс состояния. Нажми /start")
 	}
 }
 
 func (a *App) showStart(ctx context.Context, tgID int64) error {
-	p, _, err := a.sh.GetParticipant(tgID)
+	p, err := a.db.GetParticipant(ctx, tgID)
 	if err != nil {
 		return err
 	}
 	if p == nil {
 		// start registration
-		a.state[tgID] = userState{Flow: "reg", Step: 1, Data: map[string]string{}}
-		return a.SendText(tgID, "Привет! Давай зарегистрируемся. Введи Имя:")
+		if err := a.SendText(tgID, "Привет! Давай зарегистрируемся."); err != nil {
+			return err
+		}
+		return a.startFlow(ctx, tgID, "reg", nil)
 	}
 	return a.showProfile(ctx, tgID, p)
 }
@@ -148,6 +237,7 @@ func (a *App) showProfile(ctx context.Context, tgID int64, p *models.Participant
 	kb := tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("🏁 Записаться на этап", "u:stages"),
+			tgbotapi.NewInlineKeyboardButtonData("📋 Мои записи", "u:my_regs"),
 		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("👥 Сменить команду", "u:change_team"),
@@ -164,7 +254,7 @@ func (a *App) showProfile(ctx context.Context, tgID int64, p *models.Participant
 }
 
 func (a *App) showMainMenu(ctx context.Context, tgID int64) error {
-	p, _, err := a.sh.GetParticipant(tgID)
+	p, err := a.db.GetParticipant(ctx, tgID)
 	if err != nil {
 		return err
 	}
@@ -176,126 +266,30 @@ func (a *App) showMainMenu(ctx context.Context, tgID int64) error {
 
 // ---------- Callback handling ----------
 
-func (a *App) handleCallback(ctx context.Context, q *tgbotapi.CallbackQuery) error {
-	tgID := q.From.ID
-	data := q.Data
-
-	// ack
-	cb := tgbotapi.NewCallback(q.ID, "")
-	_, _ = a.bot.Request(cb)
-
-	if strings.HasPrefix(data, "u:") {
-		return a.handleUserCallback(ctx, tgID, data)
+func (a *App) sendExportLink(tgID int64, stageID string) error {
+	token := util.HMACSHA256Hex(a.cfg.PaymentWebhookSecret, "export:"+stageID)
+	url := a.cfg.BasePublicURL + "/export/stage.csv?stage_id=" + stageID + "&token=" + token
+	if a.cfg.BasePublicURL == "" {
+		url = "http://localhost" + a.cfg.HTTPAddr + "/export/stage.csv?stage_id=" + stageID + "&token=" + token
 	}
-	if strings.HasPrefix(data, "a:") {
-		if !a.isAdmin(tgID) {
-			return a.SendText(tgID, "Доступ запрещён.")
-		}
-		return a.handleAdminCallback(ctx, tgID, data)
-	}
-	return nil
+	return a.SendText(tgID, "📤 CSV выгрузка (ссылка): "+url)
 }
 
-func (a *App) handleUserCallback(ctx context.Context, tgID int64, data string) error {
-	switch data {
-	case "u:stages":
-		return a.showStages(ctx, tgID, true)
-	case "u:calendar":
-		return a.showStages(ctx, tgID, false)
-	case "u:change_team":
-		return a.showTeamPicker(ctx, tgID)
-	case "u:results":
-		return a.showStagesForResults(ctx, tgID)
-	case "u:photos":
-		return a.showStagesForPhotos(ctx, tgID)
-	}
-
-	if strings.HasPrefix(data, "u:reg_team:") {
-		team := strings.TrimPrefix(data, "u:reg_team:")
-		return a.handleUserCallbackRegTeam(ctx, tgID, team)
-	}
-
-	if strings.HasPrefix(data, "u:pick_team:") {
-		name := strings.TrimPrefix(data, "u:pick_team:")
-		if name == "__create__" {
-			a.state[tgID] = userState{Flow: "team_create", Step: 1, Data: map[string]string{}}
-			return a.SendText(tgID, "Введи название новой команды:")
-		}
-		if err := a.sh.UpdateParticipantTeam(tgID, name); err != nil {
-			return err
-		}
-		return a.SendText(tgID, "✅ Команда обновлена: "+name+" Нажми /start")
-	}
-
-	if strings.HasPrefix(data, "u:stage_join:") {
-		stageID := strings.TrimPrefix(data, "u:stage_join:")
-		return a.joinStage(ctx, tgID, stageID)
-	}
-
-	if strings.HasPrefix(data, "u:pay:") {
-		// u:pay:<stage_id>
-		stageID := strings.TrimPrefix(data, "u:pay:")
-		return a.startPayment(ctx, tgID, stageID)
+func (a *App) pickTeam(ctx context.Context, tgID int64, teamID string) error {
+	if teamID == "__create__" {
+		return a.startFlow(ctx, tgID, "team_create", nil)
 	}
-
-	if strings.HasPrefix(data, "u:result_stage:") {
-		stageID := strings.TrimPrefix(data, "u:result_stage:")
-		return a.showResult(ctx, tgID, stageID)
-	}
-
-	if strings.HasPrefix(data, "u:photo_stage:") {
-		stageID := strings.TrimPrefix(data, "u:photo_stage:")
-		return a.showPhoto(ctx, tgID, stageID)
+	t, err := a.db.GetTeam(ctx, teamID)
+	if err != nil {
+		return err
 	}
-
-	return nil
-}
-
-func (a *App) handleAdminCallback(ctx context.Context, tgID int64, data string) error {
-	switch data {
-	case "a:menu":
-		return a.showAdminMenu(tgID)
-	case "a:create_stage":
-		a.state[tgID] = userState{Flow: "admin_create_stage", Step: 1, Data: map[string]string{}}
-		return a.SendText(tgID, "Создание этапа. Введи stage_id (например: 1 или st1):")
-	case "a:list_stages":
-		return a.showStages(ctx, tgID, false)
-	case "a:broadcast":
-		a.state[tgID] = userState{Flow: "admin_broadcast", Step: 1, Data: map[string]string{}}
-		return a.SendText(tgID, "Рассылка. Введи текст сообщения (будет отправлено всем зарегистрированным):")
-	}
-
-	if strings.HasPrefix(data, "a:toggle_reg:") {
-		// a:toggle_reg:<stage_id>
-		stageID := strings.TrimPrefix(data, "a:toggle_reg:")
-		st, err := a.sh.GetStage(stageID)
-		if err != nil {
-			return err
-		}
-		if st == nil {
-			return a.SendText(tgID, "Этап не найден")
-		}
-		open := !util.NormalizeBoolRU(st.RegOpen)
-		if err := a.sh.SetStageRegOpen(stageID, open); err != nil {
-			return err
-		}
-		if open {
-			return a.SendText(tgID, "✅ Регистрация открыта для этапа "+stageID)
-		}
-		return a.SendText(tgID, "✅ Регистрация закрыта для этапа "+stageID)
+	if t == nil {
+		return a.SendText(tgID, "Команда не найдена. Нажми /start")
 	}
-
-	if strings.HasPrefix(data, "a:export:") {
-		stageID := strings.TrimPrefix(data, "a:export:")
-		token := util.HMACSHA256Hex(a.cfg.PaymentWebhookSecret, "export:"+stageID)
-		url := a.cfg.BasePublicURL + "/export/stage.csv?stage_id=" + stageID + "&token=" + token
-		if a.cfg.BasePublicURL == "" {
-			url = "http://localhost" + a.cfg.HTTPAddr + "/export/stage.csv?stage_id=" + stageID + "&token=" + token
-		}
-		return a.SendText(tgID, "📤 CSV выгрузка (ссылка): "+url)
+	if err := a.db.UpdateParticipantTeam(ctx, tgID, t.TeamName); err != nil {
+		return err
 	}
-
-	return nil
+	return a.SendText(tgID, "✅ Команда обновлена: "+t.TeamName+" Нажми /start")
 }
 
 // ---------- Screens / Menus ----------
@@ -309,7 +303,8 @@ func (a *App) showAdminMenu(tgID int64) error {
 			tgbotapi.NewInlineKeyboardButtonData("📋 Список этапов", "a:list_stages"),
 		),
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("📢 Рассылка всем", "a:broadcast"),
+			tgbotapi.NewInlineKeyboardButtonData("📢 Рассылка", "a:broadcast"),
+			tgbotapi.NewInlineKeyboardButtonData("🕒 Запланированные", "a:sched_list"),
 		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("🏠 В меню", "u:calendar"),
@@ -319,11 +314,24 @@ func (a *App) showAdminMenu(tgID int64) error {
 	return err
 }
 
-func (a *App) showStages(ctx context.Context, tgID int64, onlyOpen bool) error {
-	stages, err := a.sh.ListStages(!onlyOpen)
+// showStages lists stages by start time. Past stages and drafts are hidden
+// unless showPast is set (the admin list); then past stages are marked.
+func (a *App) showStages(ctx context.Context, tgID int64, onlyOpen, showPast bool) error {
+	stages, err := a.db.ListStages(ctx, !onlyOpen)
 	if err != nil {
 		return err
 	}
+	sortStages(stages, a.cfg.TimeZone)
+	now := time.Now()
+	if !showPast {
+		upcoming := stages[:0]
+		for _, s := range stages {
+			if stageListedForPilots(s) && !stagePast(s, a.cfg.TimeZone, now) {
+				upcoming = append(upcoming, s)
+			}
+		}
+		stages = upcoming
+	}
 	if len(stages) == 0 {
 		if onlyOpen {
 			return a.SendText(tgID, "Сейчас нет этапов с открытой регистрацией.")
@@ -333,15 +341,22 @@ func (a *App) showStages(ctx context.Context, tgID int64, onlyOpen bool) error {
 
 	text := "🏁 Этапы"
 	for _, s := range stages {
-		open := "закрыта"
-		if util.NormalizeBoolRU(s.RegOpen) {
-			open = "открыта"
+		title := "*" + s.Title + "*"
+		if stagePast(s, a.cfg.TimeZone, now) {
+			title = "✔️ " + title + " — прошёл"
 		}
-		text += fmt.Sprintf("*%s* (id: `%s`)\n 📅 %s %s\n 📍 %s\n Регистрация: %s\n Цена: %s",
-			s.Title, s.StageID, s.Date, s.Time, s.Place, open, s.Price,
+		text += fmt.Sprintf("\n\n%s (id: `%s`)\n 📅 %s\n 📍 %s\n Статус: %s\n Цена: %s",
+			title, s.StageID, a.stageWhen(s), s.Place, stageStatusTitle(s.Status), s.Price,
 		)
 		if strings.TrimSpace(s.Address) != "" {
-			text += "Адрес: " + s.Address + ""
+			text += "\n Адрес: " + s.Address
+		}
+		load, err := a.stageLoad(ctx, s)
+		if err != nil {
+			return err
+		}
+		if load != "" {
+			text += "\n " + load
 		}
 	}
 
@@ -351,15 +366,18 @@ func (a *App) showStages(ctx context.Context, tgID int64, onlyOpen bool) error {
 	// build keyboard
 	rows := [][]tgbotapi.InlineKeyboardButton{}
 	for _, s := range stages {
-		if onlyOpen && !util.NormalizeBoolRU(s.RegOpen) {
+		if onlyOpen && s.Status != models.StageRegOpen {
 			continue
 		}
-		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🏁 Записаться: "+s.Title, "u:stage_join:"+s.StageID),
-		))
+		if s.Status == models.StageRegOpen && !stagePast(s, a.cfg.TimeZone, now) {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🏁 Записаться: "+s.Title, "u:stage_join:"+s.StageID),
+			))
+		}
 		if a.isAdmin(tgID) {
 			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔓/🔒 Регистрация", "a:toggle_reg:"+s.StageID),
+				tgbotapi.NewInlineKeyboardButtonData("⚙️ Статус", "a:stage_status:"+s.StageID),
+				tgbotapi.NewInlineKeyboardButtonData("✏️ Изменить", "a:stage_edit:"+s.StageID),
 				tgbotapi.NewInlineKeyboardButtonData("📤 CSV", "a:export:"+s.StageID),
 			))
 		}
@@ -373,15 +391,15 @@ func (a *App) showStages(ctx context.Context, tgID int64, onlyOpen bool) error {
 }
 
 func (a *App) showTeamPicker(ctx context.Context, tgID int64) error {
-	teams, err := a.sh.ListTeams()
+	teams, err := a.db.ListTeams(ctx)
 	if err != nil {
 		return err
 	}
 	rows := [][]tgbotapi.InlineKeyboardButton{}
 	for _, t := range teams {
-		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(t.TeamName, "u:pick_team:"+t.TeamName),
-		))
+		if btn, ok := callbackButton(t.TeamName, "u:pick_team:"+t.TeamID); ok {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+		}
 	}
 	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
 		tgbotapi.NewInlineKeyboardButtonData("➕ Создать новую", "u:pick_team:__create__"),
@@ -395,26 +413,24 @@ func (a *App) showTeamPicker(ctx context.Context, tgID int64) error {
 // ---------- Actions ----------
 
 func (a *App) joinStage(ctx context.Context, tgID int64, stageID string) error {
-	st, err := a.sh.GetStage(stageID)
+	st, err := a.db.GetStage(ctx, stageID)
 	if err != nil {
 		return err
 	}
 	if st == nil {
 		return a.SendText(tgID, "Этап не найден.")
 	}
-	if !util.NormalizeBoolRU(st.RegOpen) {
-		return a.SendText(tgID, "Регистрация на этот этап закрыта.")
+	if st.Status == models.StageCancelled {
+		return a.SendText(tgID, "Этот этап отменён.")
 	}
-
-	has, err := a.sh.HasRegistration(stageID, tgID)
-	if err != nil {
-		return err
+	if st.Status != models.StageRegOpen {
+		return a.SendText(tgID, "Регистрация на этот этап закрыта.")
 	}
-	if has {
-		return a.SendText(tgID, "Ты уже записан на этот этап.")
+	if stagePast(*st, a.cfg.TimeZone, time.Now()) {
+		return a.SendText(tgID, "Этот этап уже прошёл.")
 	}
 
-	p, _, err := a.sh.GetParticipant(tgID)
+	p, err := a.db.GetParticipant(ctx, tgID)
 	if err != nil {
 		return err
 	}
@@ -422,30 +438,34 @@ func (a *App) joinStage(ctx context.Context, tgID int64, stageID string) error {
 		return a.SendText(tgID, "Сначала зарегистрируйся: /start")
 	}
 
-	cnt, err := a.sh.CountMainForTeam(stageID, p.TeamName)
-	if err != nil {
-		return err
-	}
-	role := "main"
-	if cnt >= 3 {
-		role = "reserve"
-	}
-
-	reg := models.Registration{
+	// uniqueness and the limits are checked atomically by the store
+	lim := a.stageLimits(*st)
+	reg, err := a.db.RegisterForStage(ctx, models.Registration{
 		StageID:   stageID,
 		TgID:      tgID,
 		TeamName:  p.TeamName,
-		Role:      role,
 		PayStatus: "unpaid",
 		CreatedAt: util.NowISO(),
+	}, lim)
+	if errors.Is(err, store.ErrAlreadyRegistered) {
+		return a.SendText(tgID, "Ты уже записан на этот этап.")
 	}
-	if err := a.sh.CreateRegistration(reg); err != nil {
+	if err != nil {
 		return err
 	}
+	role := reg.Role
 
+	if role == "waitlist" {
+		pos, err := a.waitlistPosition(ctx, stageID, tgID)
+		if err != nil {
+			return err
+		}
+		return a.SendText(tgID, fmt.Sprintf("⏳ Все места на этапе заняты, ты в листе ожидания: позиция %d. Оплачивать пока не нужно — если место освободится, бот напишет. Позиция видна в «📋 Мои записи».", pos))
+	}
 	txt := "✅ Запись создана.\n Статус: *" + role + "*\n Теперь нужно оплатить участие."
 	if role == "reserve" {
-		txt = "✅ Запись создана. ⚠️ Ты записан в *резерв* (в команде уже 3 основных пилота). Оплата доступна, но участие зависит от освобождения места."
+		txt = fmt.Sprintf("✅ Запись создана. ⚠️ Ты записан в *резерв* (в команде уже %d %s). Оплата доступна, но участие зависит от освобождения места.",
+			lim.TeamMain, plural(lim.TeamMain, "основной пилот", "основных пилота", "основных пилотов"))
 	}
 	msg := tgbotapi.NewMessage(tgID, txt)
 	msg.ParseMode = "Markdown"
@@ -459,13 +479,27 @@ func (a *App) joinStage(ctx context.Context, tgID int64, stageID string) error {
 }
 
 func (a *App) startPayment(ctx context.Context, tgID int64, stageID string) error {
-	st, err := a.sh.GetStage(stageID)
+	st, err := a.db.GetStage(ctx, stageID)
 	if err != nil {
 		return err
 	}
 	if st == nil {
 		return a.SendText(tgID, "Этап не найден.")
 	}
+	if st.Status == models.StageCancelled {
+		return a.SendText(tgID, "Этот этап отменён, оплачивать ничего не нужно.")
+	}
+	r, err := a.pilotRegistration(ctx, stageID, tgID)
+	if err != nil {
+		return err
+	}
+	ref := ""
+	if r != nil {
+		if r.Role == "waitlist" && r.PayStatus != "cancelled" {
+			return a.SendText(tgID, "Ты в листе ожидания: оплата понадобится, когда освободится место.")
+		}
+		ref = r.CreatedAt
+	}
 
 	amount := strings.TrimSpace(st.Price)
 	if amount == "" {
@@ -473,7 +507,7 @@ func (a *App) startPayment(ctx context.Context, tgID int64, stageID string) erro
 	}
 
 	returnURL := ""
-	payURL, _, err := a.pay.CreatePayment(ctx, stageID, tgID, amount, returnURL)
+	payURL, _, err := a.pay.CreatePayment(ctx, stageID, tgID, ref, amount, returnURL)
 	if err != nil {
 		return err
 	}
@@ -489,16 +523,48 @@ func (a *App) startPayment(ctx context.Context, tgID int64, stageID string) erro
 	return err
 }
 
+// sortStages orders stages by start time. Stages whose date can't be read go
+// last, in their original order.
+func sortStages(stages []models.Stage, loc *time.Location) {
+	sort.SliceStable(stages, func(i, k int) bool {
+		ti, okI := stages[i].StartsAt(loc)
+		tk, okK := stages[k].StartsAt(loc)
+		if okI != okK {
+			return okI
+		}
+		return okI && ti.Before(tk)
+	})
+}
+
+// stagePast tells whether s has started. A stage with an unreadable date never has.
+func stagePast(s models.Stage, loc *time.Location, now time.Time) bool {
+	start, ok := s.StartsAt(loc)
+	return ok && !now.Before(start)
+}
+
+// stageWhen is the date and time of s for people, as typed when it can't be read.
+func (a *App) stageWhen(s models.Stage) string {
+	if start, ok := s.StartsAt(a.cfg.TimeZone); ok {
+		return formatWhen(start, a.cfg.TimeZone)
+	}
+	return strings.TrimSpace(s.Date + " " + s.Time)
+}
+
 // ---------- Results / Photos ----------
 
 func (a *App) showStagesForResults(ctx context.Context, tgID int64) error {
-	stages, err := a.sh.ListStages(true)
+	stages, err := a.db.ListStages(ctx, true)
 	if err != nil {
 		return err
 	}
 	if len(stages) == 0 {
 		return a.SendText(tgID, "Этапов пока нет.")
 	}
+	stages = filterStages(stages, stageHasResults)
+	if len(stages) == 0 {
+		return a.SendText(tgID, "Завершённых этапов пока нет.")
+	}
+	sortStages(stages, a.cfg.TimeZone)
 	rows := [][]tgbotapi.InlineKeyboardButton{}
 	for _, s := range stages {
 		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
@@ -512,14 +578,14 @@ func (a *App) showStagesForResults(ctx context.Context, tgID int64) error {
 }
 
 func (a *App) showResult(ctx context.Context, tgID int64, stageID string) error {
-	res, err := a.sh.GetResult(stageID, tgID)
+	res, err := a.db.GetResult(ctx, stageID, tgID)
 	if err != nil {
 		return err
 	}
 	if res == nil {
 		return a.SendText(tgID, "Результатов по этому этапу пока нет.")
 	}
-	sum, _ := a.sh.SumPointsForUser(tgID)
+	sum, _ := a.db.SumPointsForUser(ctx, tgID)
 	txt := fmt.Sprintf("🏆 Результаты (этап `%s`)\n Лучшее время: *%s*\n Позиция: *%s*\n Очки за этап: *%s*\n Очки за сезон (всего): *%d*",
 		stageID, res.BestTime, res.Position, res.Points, sum,
 	)
@@ -530,13 +596,18 @@ func (a *App) showResult(ctx context.Context, tgID int64, stageID string) error
 }
 
 func (a *App) showStagesForPhotos(ctx context.Context, tgID int64) error {
-	stages, err := a.sh.ListStages(true)
+	stages, err := a.db.ListStages(ctx, true)
 	if err != nil {
 		return err
 	}
 	if len(stages) == 0 {
 		return a.SendText(tgID, "Этапов пока нет.")
 	}
+	stages = filterStages(stages, stageHasPhotos)
+	if len(stages) == 0 {
+		return a.SendText(tgID, "Фото появятся, когда начнётся первый этап.")
+	}
+	sortStages(stages, a.cfg.TimeZone)
 	rows := [][]tgbotapi.InlineKeyboardButton{}
 	for _, s := range stages {
 		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
@@ -550,7 +621,7 @@ func (a *App) showStagesForPhotos(ctx context.Context, tgID int64) error {
 }
 
 func (a *App) showPhoto(ctx context.Context, tgID int64, stageID string) error {
-	ph, err := a.sh.GetPhoto(stageID)
+	ph, err := a.db.GetPhoto(ctx, stageID)
 	if err != nil {
 		return err
 	}
@@ -563,7 +634,7 @@ func (a *App) showPhoto(ctx context.Context, tgID int64, stageID string) error {
 // ---------- CSV export builder ----------
 
 func (a *App) BuildStageCSV(ctx context.Context, stageID string) (string, error) {
-	regs, err := a.sh.ListRegistrationsForStage(stageID)
+	regs, err := a.db.ListRegistrationsForStage(ctx, stageID)
 	if err != nil {
 		return "", err
 	}
@@ -576,7 +647,7 @@ func (a *App) BuildStageCSV(ctx context.Context, stageID string) (string, error)
 	b := strings.Builder{}
 	b.WriteString(header)
 	for _, r := range regs {
-		p, _, err := a.sh.GetParticipant(r.TgID)
+		p, err := a.db.GetParticipant(ctx, r.TgID)
 		if err != nil {
 			return "", err
 		}
@@ -603,191 +674,3 @@ func escapeCSV(s string) string {
 	}
 	return s
 }
-
-// ---------- Flows ----------
-
-func (a *App) handleRegistrationFlow(ctx context.Context, tgID int64, txt string, st userState) error {
-	if st.Data == nil {
-		st.Data = map[string]string{}
-	}
-
-	switch st.Step {
-	case 1:
-		st.Data["first_name"] = txt
-		st.Step = 2
-		a.state[tgID] = st
-		return a.SendText(tgID, "Введи фамилию:")
-	case 2:
-		st.Data["last_name"] = txt
-		st.Step = 3
-		a.state[tgID] = st
-		return a.SendText(tgID, "Введи ник (как тебя подписывать в чемпионате):")
-	case 3:
-		st.Data["nick"] = txt
-		// next: team selection via keyboard
-		a.state[tgID] = st
-		return a.showTeamPickerForRegistration(ctx, tgID)
-	default:
-		a.state[tgID] = userState{}
-		return a.SendText(tgID, "Регистрация завершена. /start")
-	}
-}
-
-func (a *App) showTeamPickerForRegistration(ctx context.Context, tgID int64) error {
-	teams, err := a.sh.ListTeams()
-	if err != nil {
-		return err
-	}
-
-	rows := [][]tgbotapi.InlineKeyboardButton{}
-	for _, t := range teams {
-		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(t.TeamName, "u:reg_team:"+t.TeamName),
-		))
-	}
-	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonData("➕ Создать новую", "u:reg_team:__create__"),
-	))
-
-	msg := tgbotapi.NewMessage(tgID, "Выбери команду или создай новую:")
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
-	_, err = a.bot.Send(msg)
-	return err
-}
-
-// We reuse callback handler: add support for u:reg_team:
-func (a *App) handleUserCallbackRegTeam(ctx context.Context, tgID int64, team string) error {
-	st := a.state[tgID]
-	if st.Flow != "reg" {
-		return a.SendText(tgID, "Нажми /start")
-	}
-	if team == "__create__" {
-		a.state[tgID] = userState{Flow: "team_create", Step: 1, Data: map[string]string{"after": "reg"}}
-		return a.SendText(tgID, "Введи название новой команды:")
-	}
-	// finalize registration
-	p := models.Participant{
-		TgID:      tgID,
-		FirstName: st.Data["first_name"],
-		LastName:  st.Data["last_name"],
-		Nick:      st.Data["nick"],
-		TeamName:  team,
-		CreatedAt: util.NowISO(),
-	}
-	if err := a.sh.CreateParticipant(p); err != nil {
-		return err
-	}
-	a.state[tgID] = userState{}
-	return a.SendText(tgID, "✅ Регистрация завершена! Нажми /start")
-}
-
-func (a *App) handleTeamCreateFlow(ctx context.Context, tgID int64, txt string, st userState) error {
-	name := strings.TrimSpace(txt)
-	if name == "" {
-		return a.SendText(tgID, "Название не может быть пустым. Введи ещё раз:")
-	}
-	_, err := a.sh.CreateTeam(name)
-	if err != nil {
-		return err
-	}
-
-	after := ""
-	if st.Data != nil {
-		after = st.Data["after"]
-	}
-
-	if after == "reg" {
-		// go back to reg finalize: set team and create participant
-		// we need to simulate callback
-		return a.handleUserCallbackRegTeam(ctx, tgID, name)
-	}
-
-	// otherwise: just set in profile
-	if err := a.sh.UpdateParticipantTeam(tgID, name); err != nil {
-		return err
-	}
-	a.state[tgID] = userState{}
-	return a.SendText(tgID, "✅ Команда создана и выбрана: "+name+" Нажми /start")
-}
-
-func (a *App) handleAdminCreateStageFlow(ctx context.Context, tgID int64, txt string, st userState) error {
-	if st.Data == nil {
-		st.Data = map[string]string{}
-	}
-	switch st.Step {
-	case 1:
-		st.Data["stage_id"] = strings.TrimSpace(txt)
-		if st.Data["stage_id"] == "" {
-			return a.SendText(tgID, "stage_id пустой. Введи ещё раз:")
-		}
-		st.Step = 2
-		a.state[tgID] = st
-		return a.SendText(tgID, "Название этапа:")
-	case 2:
-		st.Data["title"] = txt
-		st.Step = 3
-		a.state[tgID] = st
-		return a.SendText(tgID, "Дата (например 2026-03-10):")
-	case 3:
-		st.Data["date"] = txt
-		st.Step = 4
-		a.state[tgID] = st
-		return a.SendText(tgID, "Время (например 18:00):")
-	case 4:
-		st.Data["time"] = txt
-		st.Step = 5
-		a.state[tgID] = st
-		return a.SendText(tgID, "Место (клуб/трасса):")
-	case 5:
-		st.Data["place"] = txt
-		st.Step = 6
-		a.state[tgID] = st
-		return a.SendText(tgID, "Адрес (можно со ссылкой на карты):")
-	case 6:
-		st.Data["address"] = txt
-		st.Step = 7
-		a.state[tgID] = st
-		return a.SendText(tgID, "Цена (число, например 1500):")
-	case 7:
-		st.Data["price"] = txt
-		// default reg_open = нет; admin can open later
-		s := models.Stage{
-			StageID: st.Data["stage_id"],
-			Title:   st.Data["title"],
-			Date:    st.Data["date"],
-			Time:    st.Data["time"],
-			Place:   st.Data["place"],
-			Address: st.Data["address"],
-			RegOpen: "нет",
-			Price:   st.Data["price"],
-		}
-		if err := a.sh.CreateStage(s); err != nil {
-			return err
-		}
-		a.state[tgID] = userState{}
-		return a.SendText(tgID, "✅ Этап создан. Регистрация по умолчанию закрыта. Нажми /admin")
-	default:
-		a.state[tgID] = userState{}
-		return a.SendText(tgID, "Сброс. /admin")
-	}
-}
-
-func (a *App) handleAdminBroadcastFlow(ctx context.Context, tgID int64, txt string, st userState) error {
-	msgText := strings.TrimSpace(txt)
-	if msgText == "" {
-		return a.SendText(tgID, "Текст пустой. Введи ещё раз:")
-	}
-	// broadcast to all participants
-	ids, err := a.sh.ListParticipantIDs()
-	if err != nil {
-		return err
-	}
-	sent := 0
-	for _, id := range ids {
-		_ = a.SendText(id, "📢 Сообщение от организаторов: "+msgText)
-		sent++
-		time.Sleep(35 * time.Millisecond) // simple anti-flood
-	}
-	a.state[tgID] = userState{}
-	return a.SendText(tgID, fmt.Sprintf("✅ Рассылка выполнена: %d получателей.", sent))
-}
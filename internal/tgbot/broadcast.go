@@ -0,0 +1,533 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/scheduler"
+)
+
+// Broadcast audiences (UserState.Data["audience"] of the admin_broadcast flow).
+// All but "all" need a target: a stage id, or a team id for "team".
+const (
+	audienceAll     = "all"
+	audienceStage   = "stage"   // registered for the stage
+	audienceUnpaid  = "unpaid"  // registered for the stage and not paid
+	audienceReserve = "reserve" // reserves of the stage
+	audienceTeam    = "team"    // members of the team
+)
+
+var audienceTitles = map[string]string{
+	audienceAll:     "Всем участникам",
+	audienceStage:   "Записанным на этап",
+	audienceUnpaid:  "Не оплатившим этап",
+	audienceReserve: "Резервам этапа",
+	audienceTeam:    "Команде",
+}
+
+func (a *App) askBroadcastAudience(ctx context.Context, tgID int64, st UserState) error {
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, aud := range []string{audienceAll, audienceStage, audienceUnpaid, audienceReserve, audienceTeam} {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(chosen(audienceTitles[aud], st.Data["audience"] == aud), "a:bc_aud:"+aud),
+		))
+	}
+	rows = append(rows, flowNavRow(st))
+	msg := tgbotapi.NewMessage(tgID, "📢 Рассылка. Кому отправить?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err := a.bot.Send(msg)
+	return err
+}
+
+func (a *App) askBroadcastTarget(ctx context.Context, tgID int64, st UserState) error {
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	text := "Выбери этап:"
+	if st.Data["audience"] == audienceTeam {
+		text = "Выбери команду:"
+		teams, err := a.db.ListTeams(ctx)
+		if err != nil {
+			return err
+		}
+		for _, t := range teams {
+			if btn, ok := callbackButton(chosen(t.TeamName, st.Data["target"] == t.TeamID), "a:bc_target:"+t.TeamID); ok {
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+			}
+		}
+	} else {
+		stages, err := a.db.ListStages(ctx, true)
+		if err != nil {
+			return err
+		}
+		sortStages(stages, a.cfg.TimeZone)
+		for _, s := range stages {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(chosen(s.Title, st.Data["target"] == s.StageID), "a:bc_target:"+s.StageID),
+			))
+		}
+	}
+	rows = append(rows, flowNavRow(st))
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err := a.bot.Send(msg)
+	return err
+}
+
+func (a *App) askBroadcastButtons(ctx context.Context, tgID int64, st UserState) error {
+	text := "Кнопки под сообщением (необязательно). Пришли каждую кнопку отдельной строкой: «Текст | ссылка», где ссылка — это\n" +
+		"• https://… — открыть сайт\n" +
+		"• stage:<id этапа> — записаться на этап\n" +
+		"• pay:<id этапа> — оплатить участие\n\n" +
+		"Например: Записаться | stage:" + stageExample(st)
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	if prev := st.Data["buttons"]; prev != "" && prev != noButtons {
+		text += "\n\nСейчас:\n" + prev
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➡️ Оставить эти кнопки", "u:flow_keep"),
+		))
+	}
+	if st.Data["target"] != "" && st.Data["audience"] != audienceTeam {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➕ «Записаться» на этот этап", "a:bc_buttons:join"),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Без кнопок", "a:bc_buttons:none"),
+	))
+	rows = append(rows, flowNavRow(st))
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err := a.bot.Send(msg)
+	return err
+}
+
+func stageExample(st UserState) string {
+	if st.Data["target"] != "" && st.Data["audience"] != audienceTeam {
+		return st.Data["target"]
+	}
+	return "stage1"
+}
+
+// askBroadcastConfirm shows the message as the first recipient will get it,
+// then the audience and the number of recipients.
+func (a *App) askBroadcastConfirm(ctx context.Context, tgID int64, st UserState) error {
+	ids, err := a.broadcastRecipients(ctx, st.Data)
+	if err != nil {
+		return err
+	}
+	label, err := a.audienceLabel(ctx, st.Data)
+	if err != nil {
+		return err
+	}
+
+	sample := tgID
+	if len(ids) > 0 {
+		sample = ids[0]
+	}
+	p, err := a.db.GetParticipant(ctx, sample)
+	if err != nil {
+		return err
+	}
+	if _, err := a.bot.Send(broadcastMessage(tgID, broadcastContent(st.Data), p)); err != nil {
+		return err
+	}
+
+	text := fmt.Sprintf("👆 Так сообщение увидит получатель.\n\nКому: %s\nПолучателей сейчас: %d\n\nОтправить сейчас или запланировать?", label, len(ids))
+	if st.Data["edit_id"] != "" {
+		text += "\n\nЭто запланированная рассылка на " + st.Data["when"] + ". «Отправить сейчас» отправит её сразу и уберёт из расписания."
+	}
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	if len(ids) > 0 {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("✅ Отправить сейчас (%d)", len(ids)), "a:bc_send"),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🕒 Запланировать", "a:bc_schedule"),
+	))
+	rows = append(rows, flowNavRow(st))
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+func (a *App) handleBroadcastAudience(ctx context.Context, tgID int64, aud string) error {
+	if _, ok := audienceTitles[aud]; !ok {
+		return nil
+	}
+	return a.answerButton(ctx, tgID, "admin_broadcast", "audience", aud)
+}
+
+func (a *App) handleBroadcastTarget(ctx context.Context, tgID int64, target string) error {
+	return a.answerButton(ctx, tgID, "admin_broadcast", "target", target)
+}
+
+func (a *App) handleBroadcastButtons(ctx context.Context, tgID int64, preset string) error {
+	st, ok := a.flowAt(tgID, "admin_broadcast", "buttons")
+	if !ok {
+		return a.SendText(tgID, "Этот шаг уже неактуален. /admin")
+	}
+	v := noButtons
+	if preset == "join" && st.Data["target"] != "" && st.Data["audience"] != audienceTeam {
+		v = "Записаться | stage:" + st.Data["target"]
+	}
+	return a.answerButton(ctx, tgID, "admin_broadcast", "buttons", v)
+}
+
+func (a *App) handleAdminBroadcastFlow(ctx context.Context, tgID int64, txt string, st UserState) error {
+	switch flowSteps[st.Flow][st.Step-1].key {
+	case "text":
+		return a.handleBroadcastContent(ctx, tgID, txt, "", st)
+	case "buttons":
+		if ok, err := a.answerStep(tgID, txt, &st); !ok {
+			return err
+		}
+		return a.nextStep(ctx, tgID, st)
+	case "when":
+		return a.scheduleBroadcast(ctx, tgID, txt, st)
+	}
+	// audience, target and confirmation are answered with buttons
+	return a.askStep(ctx, tgID, st)
+}
+
+// handleBroadcastMedia takes a photo or document sent during the broadcast flow.
+func (a *App) handleBroadcastMedia(ctx context.Context, m *tgbotapi.Message, st UserState) error {
+	tgID := m.From.ID
+	if flowSteps[st.Flow][st.Step-1].key != "text" {
+		return a.SendText(tgID, "Сейчас фото или документ не нужны.")
+	}
+	media := ""
+	switch {
+	case len(m.Photo) > 0:
+		// the last size is the largest one
+		media = "photo:" + m.Photo[len(m.Photo)-1].FileID
+	case m.Document != nil:
+		media = "document:" + m.Document.FileID
+	}
+	return a.handleBroadcastContent(ctx, tgID, strings.TrimSpace(m.Caption), media, st)
+}
+
+// handleBroadcastContent takes the message to broadcast: text, or a photo or
+// document (media is "photo:<file_id>" or "document:<file_id>") with an optional caption.
+func (a *App) handleBroadcastContent(ctx context.Context, tgID int64, text, media string, st UserState) error {
+	limit := maxMessageText
+	if media != "" {
+		limit = maxCaptionText
+	}
+	if text == "" && media == "" {
+		return a.SendText(tgID, "Пустое сообщение. Пришли текст, фото или документ:")
+	}
+	n, err := a.filledLength(ctx, st.Data, text)
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		if hasPlaceholders(text) {
+			return a.SendText(tgID, fmt.Sprintf("⚠️ Слишком длинный текст: с данными получателей до %d символов, можно не больше %d. Пришли ещё раз:", n, limit))
+		}
+		return a.SendText(tgID, fmt.Sprintf("⚠️ Слишком длинный текст: %d символов, можно не больше %d. Пришли ещё раз:", n, limit))
+	}
+	st.Data["text"] = text
+	st.Data["media"] = media
+	st.Step++
+	return a.nextStep(ctx, tgID, st)
+}
+
+func (a *App) handleBroadcastSend(ctx context.Context, tgID int64, _ string) error {
+	st, ok := a.flowAt(tgID, "admin_broadcast", "confirm")
+	if !ok {
+		return a.SendText(tgID, "Этот шаг уже неактуален. /admin")
+	}
+	if id := st.Data["edit_id"]; id != "" {
+		if err := a.sched.Remove(id); errors.Is(err, scheduler.ErrNotFound) {
+			a.state.set(tgID, UserState{})
+			return a.SendText(tgID, "Эта рассылка уже отправлена по расписанию. /admin")
+		} else if err != nil {
+			return err
+		}
+	}
+	a.state.set(tgID, UserState{})
+	return a.launchBroadcast(ctx, tgID, st.Data)
+}
+
+// launchBroadcast resolves the audience and starts a background job for it.
+func (a *App) launchBroadcast(ctx context.Context, adminID int64, data map[string]string) error {
+	ids, err := a.broadcastRecipients(ctx, data)
+	if err != nil {
+		return err
+	}
+	label, err := a.audienceLabel(ctx, data)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return a.SendText(adminID, "📢 Рассылка «"+label+"»: получателей нет, ничего не отправлено.")
+	}
+	return a.startBroadcastJob(adminID, label, broadcastContent(data), ids)
+}
+
+// startBroadcastJob sends the admin a progress message and delivers job to ids
+// in the background. Without the progress message the job runs all the same.
+func (a *App) startBroadcastJob(adminID int64, label string, job BroadcastJob, ids []int64) error {
+	job.ID = newJobID()
+	job.AdminID = adminID
+	job.Label = label
+	job.Recipients = ids
+	job.Status = jobRunning
+	job.CreatedAt = time.Now()
+	if progress, err := a.bot.Send(tgbotapi.NewMessage(adminID, broadcastReport(job))); err != nil {
+		log.Printf("broadcast %s: progress message to %d: %v", job.ID, adminID, err)
+	} else {
+		job.ProgressID = progress.MessageID
+	}
+	return a.broadcasts.add(&job)
+}
+
+func (a *App) handleBroadcastStop(ctx context.Context, tgID int64, jobID string) error {
+	if !a.broadcasts.cancel(jobID) {
+		return a.SendText(tgID, "Эта рассылка уже завершена.")
+	}
+	return nil
+}
+
+// broadcastRecipients resolves the audience chosen in the broadcast flow to chat ids, without duplicates.
+func (a *App) broadcastRecipients(ctx context.Context, data map[string]string) ([]int64, error) {
+	aud, target := data["audience"], data["target"]
+	ids := []int64{}
+	switch aud {
+	case audienceAll:
+		return a.db.ListParticipantIDs(ctx)
+	case audienceTeam:
+		t, err := a.db.GetTeam(ctx, target)
+		if err != nil || t == nil {
+			return ids, err
+		}
+		ps, err := a.db.ListParticipants(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ps {
+			if strings.EqualFold(strings.TrimSpace(p.TeamName), strings.TrimSpace(t.TeamName)) {
+				ids = append(ids, p.TgID)
+			}
+		}
+		return ids, nil
+	}
+
+	regs, err := a.db.ListRegistrationsForStage(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int64]bool{}
+	for _, r := range regs {
+		if r.PayStatus == "cancelled" || seen[r.TgID] {
+			continue
+		}
+		switch {
+		case aud == audienceStage,
+			aud == audienceUnpaid && r.PayStatus == "unpaid" && (r.Role == "main" || r.Role == "reserve"),
+			aud == audienceReserve && r.Role == "reserve":
+			seen[r.TgID] = true
+			ids = append(ids, r.TgID)
+		}
+	}
+	return ids, nil
+}
+
+func (a *App) audienceLabel(ctx context.Context, data map[string]string) (string, error) {
+	aud, target := data["audience"], data["target"]
+	label := audienceTitles[aud]
+	switch aud {
+	case audienceAll:
+		return label, nil
+	case audienceTeam:
+		t, err := a.db.GetTeam(ctx, target)
+		if err != nil {
+			return "", err
+		}
+		if t != nil {
+			target = t.TeamName
+		}
+	default:
+		s, err := a.db.GetStage(ctx, target)
+		if err != nil {
+			return "", err
+		}
+		if s != nil {
+			target = s.Title
+		}
+	}
+	return label + " «" + target + "»", nil
+}
+
+// Telegram limits on the text of a message and on the caption of a photo or document.
+const (
+	maxMessageText = 4096
+	maxCaptionText = 1024
+)
+
+// noButtons is the answer of the buttons step when the broadcast has none.
+const noButtons = "-"
+
+// BroadcastButton is an inline button under a broadcast: a link when URL is set, a callback otherwise.
+type BroadcastButton struct {
+	Text string
+	URL  string
+	Data string
+}
+
+// validateBroadcastButtons checks the answer of the buttons step.
+func validateBroadcastButtons(v string) (string, error) {
+	if _, err := parseBroadcastButtons(v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// parseBroadcastButtons reads one "Текст | ссылка" button per line.
+func parseBroadcastButtons(v string) ([]BroadcastButton, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == noButtons {
+		return nil, nil
+	}
+	out := []BroadcastButton{}
+	for _, line := range strings.Split(v, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		text, target, ok := strings.Cut(line, "|")
+		text, target = strings.TrimSpace(text), strings.TrimSpace(target)
+		if !ok || text == "" || target == "" {
+			return nil, fmt.Errorf("строка «%s»: нужен формат «Текст | ссылка»", line)
+		}
+		btn := BroadcastButton{Text: text}
+		switch {
+		case strings.HasPrefix(target, "https://"), strings.HasPrefix(target, "http://"):
+			btn.URL = target
+		case strings.HasPrefix(target, "stage:"):
+			btn.Data = "u:stage_join:" + strings.TrimSpace(strings.TrimPrefix(target, "stage:"))
+		case strings.HasPrefix(target, "pay:"):
+			btn.Data = "u:pay:" + strings.TrimSpace(strings.TrimPrefix(target, "pay:"))
+		default:
+			return nil, fmt.Errorf("строка «%s»: ссылка должна начинаться с https://, stage: или pay:", line)
+		}
+		if len(btn.Data) > maxCallbackData {
+			return nil, fmt.Errorf("строка «%s»: слишком длинный id этапа", line)
+		}
+		out = append(out, btn)
+	}
+	return out, nil
+}
+
+// broadcastContent builds the message part of a job from the broadcast flow answers.
+func broadcastContent(data map[string]string) BroadcastJob {
+	j := BroadcastJob{Text: data["text"]}
+	if kind, id, ok := strings.Cut(data["media"], ":"); ok {
+		j.MediaType, j.MediaID = kind, id
+	}
+	// the answer was validated by the buttons step
+	j.Buttons, _ = parseBroadcastButtons(data["buttons"])
+	return j
+}
+
+// broadcastMessage renders j for one recipient. p fills the placeholders and may be nil.
+func broadcastMessage(chatID int64, j BroadcastJob, p *models.Participant) tgbotapi.Chattable {
+	text := fillPlaceholders(j.Text, p)
+	var markup interface{}
+	if len(j.Buttons) > 0 {
+		rows := [][]tgbotapi.InlineKeyboardButton{}
+		for _, b := range j.Buttons {
+			if b.URL != "" {
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(b.Text, b.URL)))
+			} else {
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(b.Text, b.Data)))
+			}
+		}
+		markup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
+
+	switch j.MediaType {
+	case "photo":
+		msg := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(j.MediaID))
+		msg.Caption = text
+		msg.ReplyMarkup = markup
+		return msg
+	case "document":
+		msg := tgbotapi.NewDocument(chatID, tgbotapi.FileID(j.MediaID))
+		msg.Caption = text
+		msg.ReplyMarkup = markup
+		return msg
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = markup
+	return msg
+}
+
+var placeholders = []string{"{first_name}", "{nick}", "{team}"}
+
+func hasPlaceholders(text string) bool {
+	for _, ph := range placeholders {
+		if strings.Contains(text, ph) {
+			return true
+		}
+	}
+	return false
+}
+
+// fillPlaceholders puts the recipient's data in place of {first_name}, {nick}
+// and {team}. Without a participant they become empty.
+func fillPlaceholders(text string, p *models.Participant) string {
+	if p == nil {
+		p = &models.Participant{}
+	}
+	return strings.NewReplacer(
+		"{first_name}", p.FirstName,
+		"{nick}", p.Nick,
+		"{team}", p.TeamName,
+	).Replace(text)
+}
+
+// filledLength is the length of text once the placeholders are filled for
+// the recipient of the audience in data with the longest values.
+func (a *App) filledLength(ctx context.Context, data map[string]string, text string) (int, error) {
+	n := utf8.RuneCountInString(text)
+	if !hasPlaceholders(text) {
+		return n, nil
+	}
+	ids, err := a.broadcastRecipients(ctx, data)
+	if err != nil {
+		return 0, err
+	}
+	ps, err := a.db.ListParticipants(ctx)
+	if err != nil {
+		return 0, err
+	}
+	byID := map[int64]*models.Participant{}
+	for i := range ps {
+		byID[ps[i].TgID] = &ps[i]
+	}
+	n = utf8.RuneCountInString(fillPlaceholders(text, nil))
+	for _, id := range ids {
+		if m := utf8.RuneCountInString(fillPlaceholders(text, byID[id])); m > n {
+			n = m
+		}
+	}
+	return n, nil
+}
+
+// chosen marks the button of the current answer when a step is asked again.
+func chosen(text string, ok bool) string {
+	if ok {
+		return "✅ " + text
+	}
+	return text
+}
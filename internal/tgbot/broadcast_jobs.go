@@ -0,0 +1,325 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/persist"
+)
+
+// Broadcast job statuses.
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+const (
+	// broadcastInterval keeps all jobs together under Telegram's limit of ~30 messages a second.
+	broadcastInterval = 35 * time.Millisecond
+	// progressInterval is how often the admin's progress message is edited.
+	progressInterval = 3 * time.Second
+	// participantTries is how many times a recipient's profile is read for
+	// the placeholders before the recipient is counted as failed.
+	participantTries = 3
+)
+
+// participantRetryDelay is the pause between reads of a recipient's profile.
+var participantRetryDelay = 5 * time.Second
+
+// BroadcastJob is a broadcast delivered in the background. Next is the index
+// of the first recipient not tried yet, so after a restart the job carries on
+// from there.
+type BroadcastJob struct {
+	ID         string
+	AdminID    int64
+	ProgressID int // admin's message that shows the progress
+	Label      string
+	Text       string // may contain placeholders, see fillPlaceholders
+	MediaType  string // "", "photo" or "document"
+	MediaID    string // Telegram file_id of the photo or document
+	Buttons    []BroadcastButton
+	Recipients []int64
+	Next       int
+	Sent       int
+	Blocked    int // the user blocked the bot
+	NotFound   int // the chat does not exist any more
+	Failed     int // any other error
+	Status     string
+	CreatedAt  time.Time
+}
+
+// BroadcastStore persists unfinished broadcast jobs so they survive restarts.
+type BroadcastStore = persist.Store[[]BroadcastJob]
+
+// MemoryBroadcastStore keeps nothing between restarts.
+type MemoryBroadcastStore = persist.Memory[[]BroadcastJob]
+
+// broadcaster runs broadcast jobs. Jobs share one rate limiter, and the
+// position of every job is saved after each recipient.
+type broadcaster struct {
+	a     *App
+	store BroadcastStore
+
+	mu   sync.Mutex
+	jobs map[string]*BroadcastJob
+	ctx  context.Context
+	wg   sync.WaitGroup
+	tick <-chan time.Time
+}
+
+func newBroadcaster(a *App, store BroadcastStore) (*broadcaster, error) {
+	loaded, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	b := &broadcaster{a: a, store: store, jobs: map[string]*BroadcastJob{}}
+	for i := range loaded {
+		j := loaded[i]
+		b.jobs[j.ID] = &j
+	}
+	return b, nil
+}
+
+// start resumes the saved jobs and accepts new ones until ctx is done.
+// Jobs interrupted by ctx stay saved and are resumed after a restart.
+func (b *broadcaster) start(ctx context.Context) {
+	ticker := time.NewTicker(broadcastInterval)
+	go func() {
+		<-ctx.Done()
+		ticker.Stop()
+	}()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ctx, b.tick = ctx, ticker.C
+	for _, j := range b.jobs {
+		log.Printf("broadcast %s: resuming at %d of %d", j.ID, j.Next, len(j.Recipients))
+		b.spawn(j)
+	}
+}
+
+// wait blocks until all job goroutines have returned.
+func (b *broadcaster) wait() {
+	b.wg.Wait()
+}
+
+// add saves j and starts delivering it.
+func (b *broadcaster) add(j *BroadcastJob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ctx == nil {
+		return errors.New("broadcaster is not running")
+	}
+	b.jobs[j.ID] = j
+	b.save()
+	b.spawn(j)
+	return nil
+}
+
+// cancel stops job id. It reports false when there is no such running job.
+func (b *broadcaster) cancel(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	j, ok := b.jobs[id]
+	if !ok || j.Status != jobRunning {
+		return false
+	}
+	j.Status = jobCancelled
+	return true
+}
+
+// spawn must be called with the lock held.
+func (b *broadcaster) spawn(j *BroadcastJob) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.work(b.ctx, j)
+	}()
+}
+
+func (b *broadcaster) work(ctx context.Context, j *BroadcastJob) {
+	lastProgress := time.Time{}
+	tries := 0 // failed reads of the current recipient's profile
+	for {
+		b.mu.Lock()
+		if j.Status == jobRunning && j.Next >= len(j.Recipients) {
+			j.Status = jobDone
+		}
+		if j.Status != jobRunning {
+			final := b.finish(j)
+			b.mu.Unlock()
+			b.editProgress(final)
+			return
+		}
+		job := *j
+		to := job.Recipients[job.Next]
+		b.mu.Unlock()
+
+		var p *models.Participant
+		if hasPlaceholders(job.Text) {
+			var err error
+			if p, err = b.a.db.GetParticipant(ctx, to); err != nil {
+				log.Printf("broadcast %s: get participant %d: %v", job.ID, to, err)
+				if tries++; tries >= participantTries {
+					tries = 0
+					b.mu.Lock()
+					j.Failed++
+					j.Next++
+					b.save()
+					b.mu.Unlock()
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(participantRetryDelay):
+				}
+				continue
+			}
+			tries = 0
+		}
+
+		if time.Since(lastProgress) >= progressInterval {
+			b.progress(j)
+			lastProgress = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.tick:
+		}
+
+		_, err := b.a.bot.Send(broadcastMessage(to, job, p))
+		outcome, retryAfter := classifySendError(err)
+		if retryAfter > 0 {
+			// flood control: wait and try the same recipient again
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryAfter):
+			}
+			continue
+		}
+
+		b.mu.Lock()
+		switch outcome {
+		case sendOK:
+			j.Sent++
+		case sendBlocked:
+			j.Blocked++
+		case sendNotFound:
+			j.NotFound++
+		default:
+			j.Failed++
+		}
+		j.Next++
+		b.save()
+		b.mu.Unlock()
+	}
+}
+
+// finish must be called with the lock held. It drops j from the saved jobs
+// and returns its final state for the report.
+func (b *broadcaster) finish(j *BroadcastJob) BroadcastJob {
+	delete(b.jobs, j.ID)
+	b.save()
+	log.Printf("broadcast %s: %s, sent %d, blocked %d, not found %d, failed %d",
+		j.ID, j.Status, j.Sent, j.Blocked, j.NotFound, j.Failed)
+	return *j
+}
+
+func (b *broadcaster) progress(j *BroadcastJob) {
+	b.mu.Lock()
+	snapshot := *j
+	b.mu.Unlock()
+	b.editProgress(snapshot)
+}
+
+func (b *broadcaster) editProgress(j BroadcastJob) {
+	if j.ProgressID == 0 {
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(j.AdminID, j.ProgressID, broadcastReport(j))
+	if j.Status == jobRunning {
+		kb := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⛔️ Остановить", "a:bc_stop:"+j.ID),
+		))
+		edit.ReplyMarkup = &kb
+	}
+	if _, err := b.a.bot.Send(edit); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("broadcast %s: progress: %v", j.ID, err)
+	}
+}
+
+// save must be called with the lock held. A failed save only costs the
+// position after a restart, so it is logged and not returned.
+func (b *broadcaster) save() {
+	jobs := make([]BroadcastJob, 0, len(b.jobs))
+	for _, j := range b.jobs {
+		jobs = append(jobs, *j)
+	}
+	if err := b.store.Save(jobs); err != nil {
+		log.Printf("save broadcasts: %v", err)
+	}
+}
+
+func broadcastReport(j BroadcastJob) string {
+	head := "⏳ Рассылка идёт"
+	switch j.Status {
+	case jobDone:
+		head = "✅ Рассылка завершена"
+	case jobCancelled:
+		head = "⛔️ Рассылка остановлена"
+	}
+	return fmt.Sprintf("%s\nКому: %s\n\nОбработано: %d из %d\nДоставлено: %d\nЗаблокировали бота: %d\nЧат не найден: %d\nДругие ошибки: %d",
+		head, j.Label, j.Next, len(j.Recipients), j.Sent, j.Blocked, j.NotFound, j.Failed)
+}
+
+func newJobID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+type sendOutcome int
+
+const (
+	sendOK sendOutcome = iota
+	sendBlocked
+	sendNotFound
+	sendFailed
+)
+
+// classifySendError sorts a delivery error. A positive retryAfter means
+// Telegram asked to slow down and the message should be sent again.
+func classifySendError(err error) (sendOutcome, time.Duration) {
+	if err == nil {
+		return sendOK, 0
+	}
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) {
+		return sendFailed, 0
+	}
+	switch {
+	case tgErr.Code == 429:
+		retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		return sendFailed, retryAfter
+	case tgErr.Code == 403:
+		return sendBlocked, 0
+	case tgErr.Code == 400 && strings.Contains(strings.ToLower(tgErr.Message), "chat not found"):
+		return sendNotFound, 0
+	}
+	return sendFailed, 0
+}
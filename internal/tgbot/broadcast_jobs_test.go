@@ -0,0 +1,110 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/store"
+	"karting-bot/internal/store/memory"
+)
+
+func TestClassifySendError(t *testing.T) {
+	cases := []struct {
+		err        error
+		want       sendOutcome
+		retryAfter time.Duration
+	}{
+		{nil, sendOK, 0},
+		{&tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}, sendBlocked, 0},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}, sendNotFound, 0},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: message text is empty"}, sendFailed, 0},
+		{&tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, sendFailed, 5 * time.Second},
+		{fmt.Errorf("send: %w", &tgbotapi.Error{Code: 403}), sendBlocked, 0},
+		{errors.New("connection reset"), sendFailed, 0},
+	}
+	for _, c := range cases {
+		got, retryAfter := classifySendError(c.err)
+		if got != c.want || retryAfter != c.retryAfter {
+			t.Errorf("classifySendError(%v) = %v, %v; want %v, %v", c.err, got, retryAfter, c.want, c.retryAfter)
+		}
+	}
+}
+
+// savingBroadcasts keeps what was saved last.
+type savingBroadcasts struct {
+	jobs []BroadcastJob
+	last []BroadcastJob
+}
+
+func (s *savingBroadcasts) Load() ([]BroadcastJob, error) { return s.jobs, nil }
+func (s *savingBroadcasts) Save(jobs []BroadcastJob) error {
+	s.last = jobs
+	return nil
+}
+
+// A job saved mid-way, e.g. when the bot stopped, carries on after a restart
+// from the first recipient not tried yet.
+func TestBroadcastResumesFromSavedPosition(t *testing.T) {
+	st := &savingBroadcasts{jobs: []BroadcastJob{{ID: "b1", Text: "Привет", Recipients: []int64{1, 2, 3}, Next: 1, Sent: 1, Status: jobRunning}}}
+	bot, tg := newTestBot(t)
+	b, err := newBroadcaster(&App{bot: bot}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.start(ctx)
+	b.wait()
+
+	for id, want := range map[int64]int{1: 0, 2: 1, 3: 1} {
+		if got := len(tg.to(id)); got != want {
+			t.Errorf("recipient %d got %d messages, want %d", id, got, want)
+		}
+	}
+	if st.last == nil || len(st.last) != 0 {
+		t.Errorf("saved %+v, want the finished job dropped", st.last)
+	}
+}
+
+// failingParticipants can't read anybody's profile.
+type failingParticipants struct {
+	store.Store
+}
+
+func (failingParticipants) GetParticipant(ctx context.Context, tgID int64) (*models.Participant, error) {
+	return nil, store.ErrUnavailable
+}
+
+// A recipient whose profile can't be read for the placeholders is counted as
+// failed, and the job goes on.
+func TestBroadcastGivesUpOnUnreadableRecipient(t *testing.T) {
+	defer func(d time.Duration) { participantRetryDelay = d }(participantRetryDelay)
+	participantRetryDelay = time.Millisecond
+
+	st := &savingBroadcasts{jobs: []BroadcastJob{{ID: "b1", AdminID: 100, ProgressID: 7, Text: "Привет, {first_name}",
+		Recipients: []int64{1, 2}, Status: jobRunning}}}
+	bot, tg := newTestBot(t)
+	b, err := newBroadcaster(&App{db: failingParticipants{memory.New()}, bot: bot}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.start(ctx)
+	b.wait()
+
+	if len(tg.to(1)) != 0 || len(tg.to(2)) != 0 {
+		t.Error("a message went out without its placeholders filled")
+	}
+	report := tg.to(100)
+	if len(report) == 0 || !strings.Contains(report[len(report)-1], "Другие ошибки: 2") {
+		t.Errorf("admin report %q, want both recipients failed", report)
+	}
+}
@@ -0,0 +1,71 @@
+package tgbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/store/memory"
+)
+
+func TestParseBroadcastButtons(t *testing.T) {
+	btns, err := parseBroadcastButtons("Записаться | stage:s1\nСайт | https://example.com\n\nОплатить|pay:s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BroadcastButton{
+		{Text: "Записаться", Data: "u:stage_join:s1"},
+		{Text: "Сайт", URL: "https://example.com"},
+		{Text: "Оплатить", Data: "u:pay:s1"},
+	}
+	if len(btns) != len(want) {
+		t.Fatalf("got %d buttons, want %d", len(btns), len(want))
+	}
+	for i := range want {
+		if btns[i] != want[i] {
+			t.Errorf("button %d = %+v, want %+v", i, btns[i], want[i])
+		}
+	}
+
+	if btns, err := parseBroadcastButtons(noButtons); err != nil || len(btns) != 0 {
+		t.Errorf("no buttons: got %v, %v", btns, err)
+	}
+	for _, bad := range []string{"Записаться", "Записаться | s1", " | stage:s1"} {
+		if _, err := parseBroadcastButtons(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestFillPlaceholders(t *testing.T) {
+	p := &models.Participant{FirstName: "Иван", Nick: "Speedy", TeamName: "Red"}
+	got := fillPlaceholders("Привет, {first_name} ({nick}) из {team}!", p)
+	if want := "Привет, Иван (Speedy) из Red!"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := fillPlaceholders("{nick}!", nil); got != "!" {
+		t.Errorf("nil participant: got %q", got)
+	}
+}
+
+func TestFilledLengthTakesLongestRecipient(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	for _, p := range []models.Participant{
+		{TgID: 1, Nick: "Ас"},
+		{TgID: 2, Nick: strings.Repeat("ж", 50)},
+	} {
+		if err := db.CreateParticipant(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &App{db: db}
+	n, err := a.filledLength(ctx, map[string]string{"audience": audienceAll}, "Привет, {nick}!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 9 + 50; n != want { // "Привет, !" and the longest nick
+		t.Errorf("length = %d, want %d", n, want)
+	}
+}
@@ -0,0 +1,136 @@
+package tgbot
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Callback data has the form "<scope>:<action>[:<arg>]", scope "u" for users
+// and "a" for admins. Telegram caps it at 64 bytes, so args are short ids
+// (Team.TeamID, Stage.StageID), never names; handlers resolve them back.
+const maxCallbackData = 64
+
+// callbackHandler handles a button press; arg is the part after "<scope>:<action>:".
+type callbackHandler func(ctx context.Context, tgID int64, arg string) error
+
+func parseCallback(data string) (route, arg string) {
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) < 2 {
+		return data, ""
+	}
+	route = parts[0] + ":" + parts[1]
+	if len(parts) == 3 {
+		arg = parts[2]
+	}
+	return route, arg
+}
+
+func (a *App) callbackRoutes() map[string]callbackHandler {
+	return map[string]callbackHandler{
+		// user
+		"u:stages": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showStages(ctx, tgID, true, false)
+		},
+		"u:calendar": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showStages(ctx, tgID, false, false)
+		},
+		"u:profile": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showMainMenu(ctx, tgID)
+		},
+		"u:my_regs":        a.showMyRegistrations,
+		"u:offer_yes":      a.acceptOffer,
+		"u:offer_no":       a.declineOffer,
+		"u:reg_cancel":     a.askRegCancel,
+		"u:reg_cancel_yes": a.cancelOwnRegistration,
+		"u:change_team": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showTeamPicker(ctx, tgID)
+		},
+		"u:results": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showStagesForResults(ctx, tgID)
+		},
+		"u:photos": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showStagesForPhotos(ctx, tgID)
+		},
+		"u:flow_back":    a.flowNavHandler("u:flow_back"),
+		"u:flow_cancel":  a.flowNavHandler("u:flow_cancel"),
+		"u:flow_keep":    a.flowNavHandler("u:flow_keep"),
+		"u:reg_team":     a.handleUserCallbackRegTeam,
+		"u:pick_team":    a.pickTeam,
+		"u:stage_join":   a.joinStage,
+		"u:pay":          a.startPayment,
+		"u:result_stage": a.showResult,
+		"u:photo_stage":  a.showPhoto,
+
+		// admin
+		"a:menu": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showAdminMenu(tgID)
+		},
+		"a:create_stage": func(ctx context.Context, tgID int64, _ string) error {
+			return a.startFlow(ctx, tgID, "admin_create_stage", nil)
+		},
+		"a:list_stages": func(ctx context.Context, tgID int64, _ string) error {
+			return a.showStages(ctx, tgID, false, true)
+		},
+		"a:broadcast": func(ctx context.Context, tgID int64, _ string) error {
+			return a.startFlow(ctx, tgID, "admin_broadcast", nil)
+		},
+		"a:bc_aud":       a.handleBroadcastAudience,
+		"a:bc_target":    a.handleBroadcastTarget,
+		"a:bc_buttons":   a.handleBroadcastButtons,
+		"a:bc_schedule":  a.handleBroadcastSchedule,
+		"a:sched_list":   a.showScheduled,
+		"a:sched_open":   a.openScheduled,
+		"a:sched_edit":   a.editScheduled,
+		"a:sched_del":    a.deleteScheduled,
+		"a:bc_send":      a.handleBroadcastSend,
+		"a:bc_stop":      a.handleBroadcastStop,
+		"a:stage_edit":   a.startStageEdit,
+		"a:se_field":     a.handleStageEditField,
+		"a:se_notify":    a.handleStageEditNotify,
+		"a:stage_status": a.showStageStatus,
+		"a:set_status":   a.setStageStatus,
+		"a:cancel_stage": a.handleStageCancel,
+		"a:offers":       a.showOfferChain,
+		"a:export": func(ctx context.Context, tgID int64, stageID string) error {
+			return a.sendExportLink(tgID, stageID)
+		},
+	}
+}
+
+func (a *App) flowNavHandler(data string) callbackHandler {
+	return func(ctx context.Context, tgID int64, _ string) error {
+		return a.handleFlowNav(ctx, tgID, data)
+	}
+}
+
+func (a *App) handleCallback(ctx context.Context, q *tgbotapi.CallbackQuery) error {
+	tgID := q.From.ID
+
+	// ack
+	cb := tgbotapi.NewCallback(q.ID, "")
+	_, _ = a.bot.Request(cb)
+
+	route, arg := parseCallback(q.Data)
+	h, ok := a.routes[route]
+	if !ok {
+		log.Printf("unknown callback %q", q.Data)
+		return nil
+	}
+	if strings.HasPrefix(route, "a:") && !a.isAdmin(tgID) {
+		return a.SendText(tgID, "Доступ запрещён.")
+	}
+	return h(ctx, tgID, arg)
+}
+
+// callbackButton builds an inline button and drops payloads Telegram would reject,
+// so one bad id doesn't break the whole keyboard.
+func callbackButton(text, data string) (tgbotapi.InlineKeyboardButton, bool) {
+	if len(data) > maxCallbackData {
+		log.Printf("callback data too long (%d bytes): %q", len(data), data)
+		return tgbotapi.InlineKeyboardButton{}, false
+	}
+	return tgbotapi.NewInlineKeyboardButtonData(text, data), true
+}
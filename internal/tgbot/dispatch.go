@@ -0,0 +1,68 @@
+package tgbot
+
+import (
+	"context"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// dispatcher handles updates on a fixed pool of workers. Updates of one user
+// always go to the same worker, so they are processed in arrival order while
+// different users are served in parallel.
+type dispatcher struct {
+	queues []chan tgbotapi.Update
+	handle func(ctx context.Context, upd tgbotapi.Update)
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(workers int, handle func(ctx context.Context, upd tgbotapi.Update)) *dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &dispatcher{queues: make([]chan tgbotapi.Update, workers), handle: handle}
+	for i := range d.queues {
+		d.queues[i] = make(chan tgbotapi.Update, 64)
+	}
+	return d
+}
+
+func (d *dispatcher) start(ctx context.Context) {
+	for _, q := range d.queues {
+		d.wg.Add(1)
+		go func(q chan tgbotapi.Update) {
+			defer d.wg.Done()
+			for upd := range q {
+				d.handle(ctx, upd)
+			}
+		}(q)
+	}
+}
+
+// dispatch queues upd for its user's worker. It blocks while that worker is
+// busy and its queue is full, or until ctx is done.
+func (d *dispatcher) dispatch(ctx context.Context, upd tgbotapi.Update) {
+	q := d.queues[uint64(updateUserID(upd))%uint64(len(d.queues))]
+	select {
+	case q <- upd:
+	case <-ctx.Done():
+	}
+}
+
+// stop lets workers finish queued updates and waits for them.
+func (d *dispatcher) stop() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
+
+func updateUserID(upd tgbotapi.Update) int64 {
+	switch {
+	case upd.Message != nil && upd.Message.From != nil:
+		return upd.Message.From.ID
+	case upd.CallbackQuery != nil && upd.CallbackQuery.From != nil:
+		return upd.CallbackQuery.From.ID
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package tgbot
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func msgUpdate(userID int64, text string) tgbotapi.Update {
+	return tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: userID}, Text: text}}
+}
+
+func TestDispatcherKeepsPerUserOrder(t *testing.T) {
+	var mu sync.Mutex
+	got := map[int64][]string{}
+	d := newDispatcher(4, func(ctx context.Context, upd tgbotapi.Update) {
+		mu.Lock()
+		defer mu.Unlock()
+		id := upd.Message.From.ID
+		got[id] = append(got[id], upd.Message.Text)
+	})
+	ctx := context.Background()
+	d.start(ctx)
+
+	want := map[int64][]string{}
+	for i := 0; i < 50; i++ {
+		for _, id := range []int64{1, 2, 3, 4, 5} {
+			text := string(rune('a' + i%26))
+			want[id] = append(want[id], text)
+			d.dispatch(ctx, msgUpdate(id, text))
+		}
+	}
+	d.stop()
+
+	for id, texts := range want {
+		if len(got[id]) != len(texts) {
+			t.Fatalf("user %d: handled %d updates, want %d", id, len(got[id]), len(texts))
+		}
+		for i := range texts {
+			if got[id][i] != texts[i] {
+				t.Fatalf("user %d: update %d = %q, want %q", id, i, got[id][i], texts[i])
+			}
+		}
+	}
+}
+
+func TestDispatcherSlowUserDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan int64, 1)
+	d := newDispatcher(2, func(ctx context.Context, upd tgbotapi.Update) {
+		if upd.Message.From.ID == 1 {
+			<-release
+			return
+		}
+		done <- upd.Message.From.ID
+	})
+	ctx := context.Background()
+	d.start(ctx)
+	defer d.stop()
+	defer close(release)
+
+	d.dispatch(ctx, msgUpdate(1, "slow"))
+	d.dispatch(ctx, msgUpdate(2, "fast"))
+
+	select {
+	case id := <-done:
+		if id != 2 {
+			t.Fatalf("handled user %d, want 2", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("user 2 was blocked by user 1")
+	}
+}
+
+func TestStateMapConcurrentAccess(t *testing.T) {
+	s, err := newStateMap(MemoryStateStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := int64(0); i < 20; i++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				st := s.get(id)
+				if st.Data == nil {
+					st = UserState{Flow: "reg", Step: 1, Data: map[string]string{}}
+				}
+				st.Data["n"] = "x"
+				s.set(id, st)
+			}
+		}(i % 4)
+	}
+	wg.Wait()
+}
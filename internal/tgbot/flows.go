@@ -0,0 +1,412 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/store"
+	"karting-bot/internal/util"
+)
+
+// flowStep is one question of a multi-step flow. Steps are numbered from 1
+// (UserState.Step) and the answer is kept in UserState.Data[key].
+type flowStep struct {
+	key    string
+	prompt string
+	// ask replaces the plain text prompt, e.g. with a keyboard to pick from
+	ask func(a *App, ctx context.Context, tgID int64, st UserState) error
+	// validate normalizes the answer or returns a message for the user
+	validate func(v string) (string, error)
+	// skip tells that the step does not apply given the earlier answers
+	skip func(st UserState) bool
+}
+
+var flowSteps = map[string][]flowStep{
+	"reg": {
+		{key: "first_name", prompt: "Введи Имя:"},
+		{key: "last_name", prompt: "Введи фамилию:"},
+		{key: "nick", prompt: "Введи ник (как тебя подписывать в чемпионате):"},
+		{key: "team_name", ask: (*App).showTeamPickerForRegistration},
+		{key: "new_team", prompt: "Введи название новой команды:"},
+	},
+	"team_create": {
+		{key: "team_name", prompt: "Введи название новой команды:"},
+	},
+	"admin_create_stage": {
+		{key: "stage_id", prompt: "Создание этапа. Введи stage_id (например: 1 или st1):", validate: validateStageID},
+		{key: "title", prompt: "Название этапа:"},
+		{key: "date", prompt: "Дата (например 2026-03-10 или 10.03.2026):", validate: validateStageDate},
+		{key: "time", prompt: "Время начала по часовому поясу чемпионата (например 18:00):", validate: validateStageClock},
+		{key: "place", prompt: "Место (клуб/трасса):"},
+		{key: "address", prompt: "Адрес (можно со ссылкой на карты):"},
+		{key: "price", prompt: "Цена (число, например 1500):"},
+		{key: "capacity", prompt: "Сколько карт (всего мест для основных пилотов)? 0 — без ограничения:", validate: validateCapacity},
+	},
+	"admin_edit_stage": {
+		{key: "field", ask: (*App).askStageField},
+		{key: "value", ask: (*App).askStageValue},
+		// asked only when the change matters to registered pilots
+		{key: "notify", ask: (*App).askStageNotify},
+	},
+	"admin_cancel_stage": {
+		{key: "reason", prompt: "Отмена этапа. Напиши причину — её получат все записанные пилоты:"},
+		{key: "confirm", ask: (*App).askStageCancelConfirm},
+	},
+	"admin_broadcast": {
+		{key: "audience", ask: (*App).askBroadcastAudience},
+		{key: "target", ask: (*App).askBroadcastTarget, skip: func(st UserState) bool { return st.Data["audience"] == audienceAll }},
+		{key: "text", prompt: "Пришли сообщение для рассылки: текст, фото или документ с подписью.\n" +
+			"В тексте можно использовать {first_name}, {nick} и {team} — они заменятся данными получателя."},
+		{key: "buttons", ask: (*App).askBroadcastButtons, validate: validateBroadcastButtons},
+		{key: "confirm", ask: (*App).askBroadcastConfirm},
+		// reached only with the "schedule" button of the confirmation
+		{key: "when", prompt: "Когда отправить? Дата и время по часовому поясу чемпионата, например 15.06.2025 10:00:"},
+	},
+}
+
+// validateStageID keeps stage ids short and plain: they travel in callback data.
+func validateStageID(v string) (string, error) {
+	if len(v) > 16 {
+		return "", fmt.Errorf("stage_id слишком длинный (максимум 16 символов).")
+	}
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return "", fmt.Errorf("stage_id может содержать только латинские буквы, цифры, «-» и «_».")
+		}
+	}
+	return v, nil
+}
+
+// validateStageDate keeps stage dates in one format, so they can be read back as util.DateLayout.
+func validateStageDate(v string) (string, error) {
+	d, err := util.ParseDate(v)
+	if err != nil {
+		return "", err
+	}
+	return d.Format(util.DateLayout), nil
+}
+
+func validateStageClock(v string) (string, error) {
+	c, err := util.ParseClock(v)
+	if err != nil {
+		return "", err
+	}
+	return c.Format(util.ClockLayout), nil
+}
+
+// flowHome is the command that brings the user back to the start of their menu.
+func flowHome(flow string) string {
+	if strings.HasPrefix(flow, "admin_") {
+		return "/admin"
+	}
+	return "/start"
+}
+
+func (a *App) startFlow(ctx context.Context, tgID int64, flow string, data map[string]string) error {
+	if data == nil {
+		data = map[string]string{}
+	}
+	st := UserState{Flow: flow, Step: 1, Data: data}
+	a.state.set(tgID, st)
+	return a.askStep(ctx, tgID, st)
+}
+
+// askStep sends the question of the current step with navigation buttons.
+// When the step was answered before (the user came back), the old answer is shown and can be kept.
+func (a *App) askStep(ctx context.Context, tgID int64, st UserState) error {
+	steps := flowSteps[st.Flow]
+	if st.Step < 1 || st.Step > len(steps) {
+		return nil
+	}
+	step := steps[st.Step-1]
+	if step.ask != nil {
+		return step.ask(a, ctx, tgID, st)
+	}
+
+	text := step.prompt
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	if prev := st.Data[step.key]; prev != "" {
+		text += "\n\nСейчас: " + prev
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➡️ Оставить: "+truncate(prev, 30), "u:flow_keep"),
+		))
+	}
+	rows = append(rows, flowNavRow(st))
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err := a.bot.Send(msg)
+	return err
+}
+
+// flowNavRow is the "back / cancel" row shown under every prompt.
+func flowNavRow(st UserState) []tgbotapi.InlineKeyboardButton {
+	row := []tgbotapi.InlineKeyboardButton{}
+	if st.Step > 1 {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("⬅️ Назад", "u:flow_back"))
+	}
+	return append(row, tgbotapi.NewInlineKeyboardButtonData("✖️ Отмена", "u:flow_cancel"))
+}
+
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// answerStep validates txt, stores it as the answer of the current step and
+// moves to the next one. ok is false when the answer was rejected and the
+// question has been asked again.
+func (a *App) answerStep(tgID int64, txt string, st *UserState) (ok bool, err error) {
+	steps := flowSteps[st.Flow]
+	if st.Step < 1 || st.Step > len(steps) {
+		return false, fmt.Errorf("flow %s: bad step %d", st.Flow, st.Step)
+	}
+	step := steps[st.Step-1]
+	v := strings.TrimSpace(txt)
+	if v == "" {
+		return false, a.SendText(tgID, "Пустое значение. Введи ещё раз:")
+	}
+	if step.validate != nil {
+		if v, err = step.validate(v); err != nil {
+			return false, a.SendText(tgID, "⚠️ "+err.Error()+"\nВведи ещё раз:")
+		}
+	}
+	if st.Data == nil {
+		st.Data = map[string]string{}
+	}
+	st.Data[step.key] = v
+	st.Step++
+	return true, nil
+}
+
+// flowAt returns the state of tgID if they are in flow at the step with the given key.
+func (a *App) flowAt(tgID int64, flow, key string) (UserState, bool) {
+	st := a.state.get(tgID)
+	steps := flowSteps[flow]
+	if st.Flow != flow || st.Step < 1 || st.Step > len(steps) || steps[st.Step-1].key != key {
+		return st, false
+	}
+	return st, true
+}
+
+// answerButton stores value, picked with a button, as the answer of the step
+// with the given key and asks the next question.
+func (a *App) answerButton(ctx context.Context, tgID int64, flow, key, value string) error {
+	st, ok := a.flowAt(tgID, flow, key)
+	if !ok {
+		return a.SendText(tgID, "Этот шаг уже неактуален. "+flowHome(flow))
+	}
+	st.Data[key] = value
+	st.Step++
+	return a.nextStep(ctx, tgID, st)
+}
+
+// skipSteps moves st past the steps that don't apply, in direction dir (+1 or -1).
+func skipSteps(st *UserState, dir int) {
+	steps := flowSteps[st.Flow]
+	for st.Step >= 1 && st.Step <= len(steps) && steps[st.Step-1].skip != nil && steps[st.Step-1].skip(*st) {
+		st.Step += dir
+	}
+}
+
+// nextStep saves st and asks its question.
+func (a *App) nextStep(ctx context.Context, tgID int64, st UserState) error {
+	skipSteps(&st, +1)
+	a.state.set(tgID, st)
+	return a.askStep(ctx, tgID, st)
+}
+
+func (a *App) cancelFlow(tgID int64) error {
+	st := a.state.get(tgID)
+	a.state.set(tgID, UserState{})
+	if st.Flow == "" {
+		return a.SendText(tgID, "Нечего отменять. Нажми /start")
+	}
+	return a.SendText(tgID, "✖️ Отменено. "+flowHome(st.Flow))
+}
+
+// handleFlowNav handles the navigation buttons of the current flow.
+func (a *App) handleFlowNav(ctx context.Context, tgID int64, data string) error {
+	st := a.state.get(tgID)
+	if st.Flow == "" {
+		return a.SendText(tgID, "Этот шаг уже неактуален. Нажми /start")
+	}
+	switch data {
+	case "u:flow_cancel":
+		return a.cancelFlow(tgID)
+	case "u:flow_back":
+		st.Step--
+		skipSteps(&st, -1)
+		if st.Step < 1 {
+			return a.cancelFlow(tgID)
+		}
+		return a.nextStep(ctx, tgID, st)
+	case "u:flow_keep":
+		steps := flowSteps[st.Flow]
+		if st.Step < 1 || st.Step > len(steps) {
+			return nil
+		}
+		if st.Flow == "admin_broadcast" && steps[st.Step-1].key == "text" {
+			// the message may be a photo, which can't be replayed as text
+			st.Step++
+			return a.nextStep(ctx, tgID, st)
+		}
+		return a.handleFlowInput(ctx, tgID, st.Data[steps[st.Step-1].key], st)
+	}
+	return nil
+}
+
+// ---------- Flows ----------
+
+func (a *App) handleRegistrationFlow(ctx context.Context, tgID int64, txt string, st UserState) error {
+	switch st.Step {
+	case 1, 2, 3:
+		if ok, err := a.answerStep(tgID, txt, &st); !ok {
+			return err
+		}
+		// after the nick: team selection via keyboard
+		return a.nextStep(ctx, tgID, st)
+	case 4:
+		// the team is picked with a button; show the picker again
+		return a.askStep(ctx, tgID, st)
+	case 5:
+		if ok, err := a.answerStep(tgID, txt, &st); !ok {
+			return err
+		}
+		name := st.Data["new_team"]
+		if _, err := a.db.CreateTeam(ctx, name); err != nil {
+			if errors.Is(err, store.ErrTeamExists) {
+				return a.SendText(tgID, teamExistsText)
+			}
+			return err
+		}
+		return a.finishRegistration(ctx, tgID, st, name)
+	default:
+		a.state.set(tgID, UserState{})
+		return a.SendText(tgID, "Регистрация завершена. /start")
+	}
+}
+
+func (a *App) showTeamPickerForRegistration(ctx context.Context, tgID int64, st UserState) error {
+	teams, err := a.db.ListTeams(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, t := range teams {
+		if btn, ok := callbackButton(t.TeamName, "u:reg_team:"+t.TeamID); ok {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+		}
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("➕ Создать новую", "u:reg_team:__create__"),
+	))
+	rows = append(rows, flowNavRow(st))
+
+	msg := tgbotapi.NewMessage(tgID, "Выбери команду или создай новую:")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+// u:reg_team:<team_id> — team picked during registration
+func (a *App) handleUserCallbackRegTeam(ctx context.Context, tgID int64, teamID string) error {
+	st := a.state.get(tgID)
+	if st.Flow != "reg" || st.Step != 4 {
+		return a.SendText(tgID, "Нажми /start")
+	}
+	if teamID == "__create__" {
+		st.Step = 5
+		return a.nextStep(ctx, tgID, st)
+	}
+	t, err := a.db.GetTeam(ctx, teamID)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return a.SendText(tgID, "Команда не найдена, выбери другую.")
+	}
+	return a.finishRegistration(ctx, tgID, st, t.TeamName)
+}
+
+func (a *App) finishRegistration(ctx context.Context, tgID int64, st UserState, team string) error {
+	p := models.Participant{
+		TgID:      tgID,
+		FirstName: st.Data["first_name"],
+		LastName:  st.Data["last_name"],
+		Nick:      st.Data["nick"],
+		TeamName:  team,
+		CreatedAt: util.NowISO(),
+	}
+	if err := a.db.CreateParticipant(ctx, p); err != nil {
+		return err
+	}
+	a.state.set(tgID, UserState{})
+	return a.SendText(tgID, "✅ Регистрация завершена! Нажми /start")
+}
+
+const teamExistsText = "Команда с таким названием уже есть — выбери её из списка (⬅️ Назад) или введи другое название:"
+
+func (a *App) handleTeamCreateFlow(ctx context.Context, tgID int64, txt string, st UserState) error {
+	if ok, err := a.answerStep(tgID, txt, &st); !ok {
+		return err
+	}
+	name := st.Data["team_name"]
+	if _, err := a.db.CreateTeam(ctx, name); err != nil {
+		if errors.Is(err, store.ErrTeamExists) {
+			return a.SendText(tgID, teamExistsText)
+		}
+		return err
+	}
+	if err := a.db.UpdateParticipantTeam(ctx, tgID, name); err != nil {
+		return err
+	}
+	a.state.set(tgID, UserState{})
+	return a.SendText(tgID, "✅ Команда создана и выбрана: "+name+" Нажми /start")
+}
+
+func (a *App) handleAdminCreateStageFlow(ctx context.Context, tgID int64, txt string, st UserState) error {
+	if ok, err := a.answerStep(tgID, txt, &st); !ok {
+		return err
+	}
+	if flowSteps[st.Flow][st.Step-2].key == "time" {
+		start, _ := models.Stage{Date: st.Data["date"], Time: st.Data["time"]}.StartsAt(a.cfg.TimeZone)
+		if start.Before(time.Now()) {
+			if err := a.SendText(tgID, "⚠️ "+formatWhen(start, a.cfg.TimeZone)+" уже прошло. Введи дату ещё раз."); err != nil {
+				return err
+			}
+			st.Step -= 2
+			return a.nextStep(ctx, tgID, st)
+		}
+	}
+	if st.Step <= len(flowSteps[st.Flow]) {
+		return a.nextStep(ctx, tgID, st)
+	}
+
+	// a new stage is a draft: pilots don't see it until registration is opened
+	s := models.Stage{
+		StageID:  st.Data["stage_id"],
+		Title:    st.Data["title"],
+		Date:     st.Data["date"],
+		Time:     st.Data["time"],
+		Place:    st.Data["place"],
+		Address:  st.Data["address"],
+		Price:    st.Data["price"],
+		Capacity: st.Data["capacity"],
+	}
+	s.SetStatus(models.StageDraft)
+	if err := a.db.CreateStage(ctx, s); err != nil {
+		return err
+	}
+	a.state.set(tgID, UserState{})
+	return a.SendText(tgID, "✅ Этап создан как черновик, пилоты его пока не видят. Открыть регистрацию: /admin → Список этапов → ⚙️ Статус")
+}
@@ -0,0 +1,73 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/store"
+)
+
+// stageLimits reads the limits of s; a missing or broken team_limit falls
+// back to TEAM_MAIN_LIMIT, a missing capacity means no limit.
+func (a *App) stageLimits(s models.Stage) store.Limits {
+	lim := store.Limits{TeamMain: a.cfg.TeamMainLimit}
+	if n, err := strconv.Atoi(strings.TrimSpace(s.TeamLimit)); err == nil && n > 0 {
+		lim.TeamMain = n
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(s.Capacity)); err == nil && n > 0 {
+		lim.Capacity = n
+	}
+	return lim
+}
+
+// validateCapacity accepts a number of karts; 0 means no limit.
+func validateCapacity(v string) (string, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("Нужно целое число, 0 — без ограничения.")
+	}
+	return strconv.Itoa(n), nil
+}
+
+// validateTeamLimit accepts a positive number, or "-" for the default limit.
+func validateTeamLimit(v string) (string, error) {
+	if strings.TrimSpace(v) == "-" {
+		return "", nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 1 {
+		return "", fmt.Errorf("Нужно целое число от 1, или «-» — по умолчанию.")
+	}
+	return strconv.Itoa(n), nil
+}
+
+// stageLoad is the "Места: 12/20, в листе ожидания: 3" line of a stage with
+// a capacity, empty otherwise.
+func (a *App) stageLoad(ctx context.Context, s models.Stage) (string, error) {
+	lim := a.stageLimits(s)
+	if lim.Capacity == 0 {
+		return "", nil
+	}
+	regs, err := a.db.ListRegistrationsForStage(ctx, s.StageID)
+	if err != nil {
+		return "", err
+	}
+	text := fmt.Sprintf("Места: %d/%d", store.CountPlaces(regs), lim.Capacity)
+	if n := len(store.Queue(regs, "waitlist")); n > 0 {
+		text += fmt.Sprintf(", в листе ожидания: %d", n)
+	}
+	return text, nil
+}
+
+// waitlistPosition is the place of tgID on the waitlist of stageID, 0 when
+// the pilot is not on it.
+func (a *App) waitlistPosition(ctx context.Context, stageID string, tgID int64) (int, error) {
+	regs, err := a.db.ListRegistrationsForStage(ctx, stageID)
+	if err != nil {
+		return 0, err
+	}
+	return store.WaitlistPosition(regs, tgID), nil
+}
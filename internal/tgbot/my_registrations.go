@@ -0,0 +1,248 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+)
+
+var payStatusTitles = map[string]string{
+	"unpaid":    "не оплачено",
+	"paid":      "оплачено",
+	"cancelled": "отменена",
+}
+
+var roleTitles = map[string]string{
+	"main":     "основной состав",
+	"reserve":  "резерв",
+	"waitlist": "лист ожидания",
+	"offered":  "предложено место из листа ожидания — ответь на сообщение бота",
+}
+
+// myRegistration is an active registration with its stage.
+type myRegistration struct {
+	Reg   models.Registration
+	Stage models.Stage
+}
+
+// myRegistrations are the active registrations of tgID on stages that are
+// not over yet, by stage start.
+func (a *App) myRegistrations(ctx context.Context, tgID int64) ([]myRegistration, error) {
+	regs, err := a.db.ListRegistrationsForPilot(ctx, tgID)
+	if err != nil {
+		return nil, err
+	}
+	byStage := map[string]models.Registration{}
+	for _, r := range regs {
+		if r.PayStatus != "cancelled" {
+			byStage[r.StageID] = r
+		}
+	}
+	stages, err := a.db.ListStages(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	sortStages(stages, a.cfg.TimeZone)
+	out := []myRegistration{}
+	for _, s := range stages {
+		r, ok := byStage[s.StageID]
+		if !ok || s.Status == models.StageFinished || s.Status == models.StageCancelled {
+			continue
+		}
+		out = append(out, myRegistration{Reg: r, Stage: s})
+	}
+	return out, nil
+}
+
+func (a *App) showMyRegistrations(ctx context.Context, tgID int64, _ string) error {
+	mine, err := a.myRegistrations(ctx, tgID)
+	if err != nil {
+		return err
+	}
+	home := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🏠 В профиль", "u:profile"))
+	if len(mine) == 0 {
+		msg := tgbotapi.NewMessage(tgID, "У тебя нет записей на предстоящие этапы.")
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🏁 Записаться на этап", "u:stages")),
+			home,
+		)
+		_, err = a.bot.Send(msg)
+		return err
+	}
+
+	now := time.Now()
+	text := "📋 Мои записи"
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, m := range mine {
+		role := roleTitles[m.Reg.Role]
+		if m.Reg.Role == "waitlist" {
+			pos, err := a.waitlistPosition(ctx, m.Stage.StageID, tgID)
+			if err != nil {
+				return err
+			}
+			role += fmt.Sprintf(", позиция %d", pos)
+		}
+		text += fmt.Sprintf("\n\n🏁 %s\n 📅 %s\n Роль: %s\n Оплата: %s",
+			m.Stage.Title, a.stageWhen(m.Stage), role, payStatusTitles[m.Reg.PayStatus])
+		if m.Reg.Role == "main" && m.Reg.PayStatus == "unpaid" {
+			if due, ok := a.payDue(m.Stage, m.Reg); ok {
+				text += ", оплатить до " + formatWhen(a.payCancelTime(m.Reg, due, now), a.cfg.TimeZone)
+			}
+		}
+		row := []tgbotapi.InlineKeyboardButton{}
+		if m.Reg.PayStatus == "unpaid" && (m.Reg.Role == "main" || m.Reg.Role == "reserve") {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить", "u:pay:"+m.Stage.StageID))
+		}
+		if a.cancelAllowed(m.Stage, now) == nil {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData("❌ Отменить запись", "u:reg_cancel:"+m.Stage.StageID))
+		} else {
+			text += "\n Отменить запись уже нельзя"
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	if a.cfg.CancelDeadline > 0 {
+		text += fmt.Sprintf("\n\nОтменить запись можно не позже чем за %s до старта.", durationText(a.cfg.CancelDeadline))
+	}
+	rows = append(rows, home)
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+// cancelAllowed tells why a pilot can't cancel their registration on s at
+// now, or returns nil when they can.
+func (a *App) cancelAllowed(s models.Stage, now time.Time) error {
+	if s.Status != models.StageRegOpen && s.Status != models.StageRegClosed {
+		return fmt.Errorf("этап уже идёт или завершён")
+	}
+	start, ok := s.StartsAt(a.cfg.TimeZone)
+	if !ok {
+		return nil
+	}
+	if !now.Before(start.Add(-a.cfg.CancelDeadline)) {
+		if a.cfg.CancelDeadline <= 0 {
+			return fmt.Errorf("этап уже начался")
+		}
+		return fmt.Errorf("отменить запись можно не позже чем за %s до старта", durationText(a.cfg.CancelDeadline))
+	}
+	return nil
+}
+
+// askRegCancel asks the pilot to confirm the cancellation.
+func (a *App) askRegCancel(ctx context.Context, tgID int64, stageID string) error {
+	s, err := a.db.GetStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return a.SendText(tgID, "Этап не найден.")
+	}
+	r, err := a.pilotRegistration(ctx, stageID, tgID)
+	if err != nil {
+		return err
+	}
+	if r == nil || r.PayStatus == "cancelled" {
+		return a.SendText(tgID, "Активной записи на этот этап нет.")
+	}
+	text := fmt.Sprintf("Отменить запись на этап «%s» (%s)?", s.Title, a.stageWhen(*s))
+	if r.PayStatus == "paid" {
+		text += "\n\nУчастие оплачено — мы запросим возврат денег."
+	}
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("❌ Да, отменить", "u:reg_cancel_yes:"+stageID),
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ Назад", "u:my_regs"),
+	))
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+// cancelOwnRegistration cancels the registration of tgID on stageID, asks
+// for a refund when it was paid and gives a main place to the team's reserve.
+// The registration is read again under the stage lock, so a payment that
+// comes in meanwhile is either refunded here or finds it cancelled.
+func (a *App) cancelOwnRegistration(ctx context.Context, tgID int64, stageID string) error {
+	s, err := a.db.GetStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return a.SendText(tgID, "Этап не найден.")
+	}
+	r, err := a.pilotRegistration(ctx, stageID, tgID)
+	if err != nil {
+		return err
+	}
+	if r == nil || r.PayStatus == "cancelled" {
+		return a.SendText(tgID, "Активной записи на этот этап нет.")
+	}
+	if err := a.cancelAllowed(*s, time.Now()); err != nil {
+		return a.SendText(tgID, "⚠️ Не получилось: "+err.Error()+". Если не сможешь приехать, напиши организатору.")
+	}
+
+	err = a.locked(stageID, func() error {
+		// read again: a payment may have come in since
+		var err error
+		if r, err = a.pilotRegistration(ctx, stageID, tgID); err != nil || r == nil || r.PayStatus == "cancelled" {
+			return err
+		}
+		if r.PayStatus == "paid" && r.Refund != refundRequested {
+			r.Refund = a.requestRefund(ctx, *s, *r)
+			if err := a.db.UpdateRefund(ctx, stageID, tgID, r.Refund); err != nil {
+				return err
+			}
+		}
+		return a.db.UpdatePayStatus(ctx, stageID, tgID, "cancelled")
+	})
+	if err != nil {
+		return err
+	}
+	if r == nil || r.PayStatus == "cancelled" {
+		return a.SendText(tgID, "Активной записи на этот этап нет.")
+	}
+	log.Printf("stage %s: pilot %d cancelled the registration (%s, %s)", stageID, tgID, r.Role, r.PayStatus)
+	if err := a.FillFreedPlace(ctx, stageID, tgID); err != nil {
+		return err
+	}
+
+	text := fmt.Sprintf("✅ Запись на этап «%s» отменена.", s.Title)
+	switch {
+	case r.PayStatus != "paid":
+	case r.Refund == refundRequested:
+		text += "\nВозврат оплаты запрошен."
+	default:
+		text += "\n⚠️ Автоматический возврат не прошёл — организатор вернёт деньги вручную."
+		a.tellAdmins(fmt.Sprintf("⚠️ Возврат не прошёл: %s отменил(а) запись на этап «%s», оплата %s. Верни вручную.",
+			a.pilotLabel(ctx, tgID), s.Title, s.Price))
+	}
+	return a.SendText(tgID, text)
+}
+
+// pilotRegistration is the registration of tgID on stageID, nil if there is none.
+func (a *App) pilotRegistration(ctx context.Context, stageID string, tgID int64) (*models.Registration, error) {
+	regs, err := a.db.ListRegistrationsForPilot(ctx, tgID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range regs {
+		if regs[i].StageID == stageID {
+			return &regs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// tellAdmins sends text to every admin; failures are only logged.
+func (a *App) tellAdmins(text string) {
+	for id := range a.cfg.AdminTGIDs {
+		a.notify(id, tgbotapi.NewMessage(id, text))
+	}
+}
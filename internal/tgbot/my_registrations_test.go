@@ -0,0 +1,38 @@
+package tgbot
+
+import (
+	"testing"
+	"time"
+
+	"karting-bot/internal/config"
+	"karting-bot/internal/models"
+)
+
+func TestCancelAllowed(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Moscow")
+	a := &App{cfg: config.Config{TimeZone: loc, CancelDeadline: 24 * time.Hour}}
+	s := models.Stage{Date: "2030-06-15", Time: "10:00", Status: models.StageRegOpen}
+	start := time.Date(2030, 6, 15, 10, 0, 0, 0, loc)
+
+	if err := a.cancelAllowed(s, start.Add(-25*time.Hour)); err != nil {
+		t.Errorf("25h before the start: %v", err)
+	}
+	if err := a.cancelAllowed(s, start.Add(-23*time.Hour)); err == nil {
+		t.Error("23h before the start: cancellation allowed past the deadline")
+	}
+
+	s.Status = models.StageRunning
+	if err := a.cancelAllowed(s, start.Add(-48*time.Hour)); err == nil {
+		t.Error("running stage: cancellation allowed")
+	}
+
+	// no deadline: until the start
+	a.cfg.CancelDeadline = 0
+	s.Status = models.StageRegClosed
+	if err := a.cancelAllowed(s, start.Add(-time.Minute)); err != nil {
+		t.Errorf("a minute before the start without deadline: %v", err)
+	}
+	if err := a.cancelAllowed(s, start); err == nil {
+		t.Error("at the start: cancellation allowed")
+	}
+}
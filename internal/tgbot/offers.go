@@ -0,0 +1,382 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/persist"
+	"karting-bot/internal/scheduler"
+	"karting-bot/internal/store"
+)
+
+// jobOfferExpiry is the scheduler job kind that withdraws an unanswered
+// waitlist offer. Its Data holds stage_id and tg_id.
+const jobOfferExpiry = "offer_expiry"
+
+// Waitlist offer statuses.
+const (
+	offerPending   = "pending"
+	offerAccepted  = "accepted"
+	offerDeclined  = "declined"
+	offerExpired   = "expired"
+	offerWithdrawn = "withdrawn" // the stage was cancelled
+)
+
+var offerStatusTitles = map[string]string{
+	offerPending:   "⏳ ждём ответа",
+	offerAccepted:  "✅ принял(а)",
+	offerDeclined:  "❌ отказался(ась)",
+	offerExpired:   "⌛️ не ответил(а) вовремя",
+	offerWithdrawn: "🚫 отозвано",
+}
+
+// WaitlistOffer is a free place offered to a pilot from the waitlist. The
+// registration has the role "offered" while the offer is pending.
+type WaitlistOffer struct {
+	StageID   string
+	TgID      int64
+	OfferedAt time.Time
+	ExpiresAt time.Time
+	JobID     string // the jobOfferExpiry job
+	Status    string
+	DecidedAt time.Time
+}
+
+// OfferStore persists the offers, so admins can follow the chain of a stage.
+type OfferStore = persist.Store[[]WaitlistOffer]
+
+// MemoryOfferStore keeps nothing between restarts.
+type MemoryOfferStore = persist.Memory[[]WaitlistOffer]
+
+// offerKeep is how long answered offers stay in the log.
+const offerKeep = 90 * 24 * time.Hour
+
+// offerLog is the history of waitlist offers.
+type offerLog struct {
+	mu     sync.Mutex
+	offers []WaitlistOffer
+	store  OfferStore
+}
+
+func newOfferLog(store OfferStore) (*offerLog, error) {
+	loaded, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	offers := []WaitlistOffer{}
+	for _, o := range loaded {
+		if o.Status == offerPending || time.Since(o.DecidedAt) < offerKeep {
+			offers = append(offers, o)
+		}
+	}
+	return &offerLog{offers: offers, store: store}, nil
+}
+
+func (l *offerLog) add(o WaitlistOffer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.offers = append(l.offers, o)
+	l.save()
+}
+
+func (l *offerLog) pending(stageID string, tgID int64) (WaitlistOffer, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, o := range l.offers {
+		if o.StageID == stageID && o.TgID == tgID && o.Status == offerPending {
+			return o, true
+		}
+	}
+	return WaitlistOffer{}, false
+}
+
+// close answers the pending offer of tgID on stageID. It reports false when
+// there is none, e.g. the pilot pressed a button twice.
+func (l *offerLog) close(stageID string, tgID int64, status string) (WaitlistOffer, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.offers {
+		o := &l.offers[i]
+		if o.StageID == stageID && o.TgID == tgID && o.Status == offerPending {
+			o.Status, o.DecidedAt = status, time.Now()
+			l.save()
+			return *o, true
+		}
+	}
+	return WaitlistOffer{}, false
+}
+
+func (l *offerLog) forStage(stageID string) []WaitlistOffer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []WaitlistOffer{}
+	for _, o := range l.offers {
+		if o.StageID == stageID {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// save must be called with the lock held. A failed save only costs the
+// history, so it is logged.
+func (l *offerLog) save() {
+	if err := l.store.Save(l.offers); err != nil {
+		log.Printf("save offers: %v", err)
+	}
+}
+
+// offerFreePlaces offers every free kart of s to the waitlist, one pilot per kart.
+func (a *App) offerFreePlaces(ctx context.Context, s models.Stage) error {
+	if s.Status != models.StageRegOpen && s.Status != models.StageRegClosed {
+		return nil
+	}
+	lim := a.stageLimits(s)
+	for {
+		r, err := a.db.OfferWaitlist(ctx, s.StageID, lim)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return nil
+		}
+		if err := a.sendOffer(ctx, s, *r); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *App) sendOffer(ctx context.Context, s models.Stage, r models.Registration) error {
+	now := time.Now()
+	expires := now.Add(a.cfg.OfferTTL)
+	if start, ok := s.StartsAt(a.cfg.TimeZone); ok && start.Before(expires) {
+		expires = start
+	}
+	job, err := a.sched.Add(scheduler.Job{
+		Kind:  jobOfferExpiry,
+		RunAt: expires,
+		Data:  map[string]string{"stage_id": s.StageID, "tg_id": strconv.FormatInt(r.TgID, 10)},
+	})
+	if err != nil {
+		// without the expiry job nobody could answer the offer: the pilot
+		// goes back to the waitlist and the kart stays free
+		_ = a.sched.Remove(job.ID)
+		if rerr := a.db.UpdateRole(ctx, s.StageID, r.TgID, "waitlist"); rerr != nil {
+			log.Printf("stage %s: put %d back on the waitlist: %v", s.StageID, r.TgID, rerr)
+		}
+		return fmt.Errorf("schedule offer expiry: %w", err)
+	}
+	a.offers.add(WaitlistOffer{StageID: s.StageID, TgID: r.TgID, OfferedAt: now, ExpiresAt: expires, JobID: job.ID, Status: offerPending})
+	log.Printf("stage %s: place offered to %d from the waitlist until %s", s.StageID, r.TgID, expires.Format(time.RFC3339))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "🎉 На этапе «%s» (%s) освободилось место, и оно твоё — если подтвердишь до %s.\n\n",
+		s.Title, a.stageWhen(s), formatWhen(expires, a.cfg.TimeZone))
+	b.WriteString("Нажми «Принять» и оплати участие. Если откажешься или не ответишь вовремя, место перейдёт следующему в листе ожидания.")
+	amount := strings.TrimSpace(s.Price)
+	if amount == "" {
+		amount = "0"
+	}
+	if payURL, _, err := a.pay.CreatePayment(ctx, s.StageID, r.TgID, r.CreatedAt, amount, ""); err != nil {
+		log.Printf("offer %s to %d: payment link: %v", s.StageID, r.TgID, err)
+	} else {
+		fmt.Fprintf(&b, "\n\n💳 Оплата (%s): %s", amount, payURL)
+	}
+	msg := tgbotapi.NewMessage(r.TgID, b.String())
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("✅ Принять", "u:offer_yes:"+s.StageID),
+		tgbotapi.NewInlineKeyboardButtonData("❌ Отказаться", "u:offer_no:"+s.StageID),
+	))
+	// a pilot who did not get the message doesn't answer: the expiry job
+	// passes the place on
+	a.notify(r.TgID, msg)
+	return nil
+}
+
+// acceptOffer makes the pilot a main one. Paying for the stage accepts the
+// offer as well, see PaymentConfirmed.
+func (a *App) acceptOffer(ctx context.Context, tgID int64, stageID string) error {
+	taken := false
+	err := a.locked(stageID, func() (err error) {
+		taken, err = a.takeOffer(ctx, stageID, tgID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !taken {
+		return a.SendText(tgID, "Это предложение уже неактуально. Свои записи смотри в «📋 Мои записи».")
+	}
+	r, err := a.pilotRegistration(ctx, stageID, tgID)
+	if err != nil {
+		return err
+	}
+	msg := tgbotapi.NewMessage(tgID, "✅ Место твоё: ты в основном составе.")
+	if r != nil && r.PayStatus == "unpaid" {
+		msg.Text += " Осталось оплатить участие."
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить", "u:pay:"+stageID),
+		))
+	}
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+// pendingOffer is the pending offer to tgID on stageID whose registration is
+// still waiting for the answer. The caller holds the stage lock.
+func (a *App) pendingOffer(ctx context.Context, stageID string, tgID int64) (WaitlistOffer, bool, error) {
+	o, ok := a.offers.pending(stageID, tgID)
+	if !ok {
+		return o, false, nil
+	}
+	r, err := a.pilotRegistration(ctx, stageID, tgID)
+	if err != nil {
+		return o, false, err
+	}
+	// a registration cancelled another way gets its offer closed right after
+	return o, r != nil && r.Role == "offered" && r.PayStatus != "cancelled", nil
+}
+
+// takeOffer makes the pilot of a pending offer a main one; false when the
+// offer is not pending any more. The caller holds the stage lock.
+func (a *App) takeOffer(ctx context.Context, stageID string, tgID int64) (bool, error) {
+	o, ok, err := a.pendingOffer(ctx, stageID, tgID)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := a.db.UpdateRole(ctx, stageID, tgID, "main"); err != nil {
+		return false, err
+	}
+	a.offers.close(stageID, tgID, offerAccepted)
+	a.dropOfferJob(o)
+	log.Printf("stage %s: %d accepted the place from the waitlist", stageID, tgID)
+	return true, nil
+}
+
+// dropOffer cancels the registration of a pending offer and closes the offer
+// with status; false when the offer is not pending any more. The place is
+// passed on by FillFreedPlace, after the lock is released.
+func (a *App) dropOffer(ctx context.Context, stageID string, tgID int64, status string) (dropped bool, err error) {
+	err = a.locked(stageID, func() error {
+		o, ok, err := a.pendingOffer(ctx, stageID, tgID)
+		if err != nil || !ok {
+			return err
+		}
+		if err := a.db.UpdatePayStatus(ctx, stageID, tgID, "cancelled"); err != nil {
+			return err
+		}
+		a.offers.close(stageID, tgID, status)
+		a.dropOfferJob(o)
+		dropped = true
+		return nil
+	})
+	return dropped, err
+}
+
+// declineOffer cancels the registration and passes the place on.
+func (a *App) declineOffer(ctx context.Context, tgID int64, stageID string) error {
+	dropped, err := a.dropOffer(ctx, stageID, tgID, offerDeclined)
+	if err != nil {
+		return err
+	}
+	if !dropped {
+		return a.SendText(tgID, "Это предложение уже неактуально.")
+	}
+	log.Printf("stage %s: %d declined the place from the waitlist", stageID, tgID)
+	if err := a.SendText(tgID, "Понятно, место передано следующему. Запись в листе ожидания снята."); err != nil {
+		return err
+	}
+	return a.FillFreedPlace(ctx, stageID, tgID)
+}
+
+// runOfferExpiry is the scheduler handler of jobOfferExpiry.
+func (a *App) runOfferExpiry(ctx context.Context, j scheduler.Job) error {
+	stageID := j.Data["stage_id"]
+	tgID, err := strconv.ParseInt(j.Data["tg_id"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("offer expiry: bad tg_id %q", j.Data["tg_id"])
+	}
+	dropped, err := a.dropOffer(ctx, stageID, tgID, offerExpired)
+	if err != nil || !dropped {
+		return err
+	}
+	log.Printf("stage %s: the offer to %d expired", stageID, tgID)
+	a.notify(tgID, tgbotapi.NewMessage(tgID, "⌛️ Время на ответ вышло: место передано следующему в листе ожидания, твоя запись снята. Записаться снова можно в календаре."))
+	return a.FillFreedPlace(ctx, stageID, tgID)
+}
+
+// closeOffer answers a pending offer without the pilot, e.g. when the
+// registration is cancelled another way.
+func (a *App) closeOffer(stageID string, tgID int64, status string) {
+	if o, ok := a.offers.close(stageID, tgID, status); ok {
+		a.dropOfferJob(o)
+	}
+}
+
+func (a *App) dropOfferJob(o WaitlistOffer) {
+	if err := a.sched.Remove(o.JobID); err != nil && !errors.Is(err, scheduler.ErrNotFound) {
+		log.Printf("remove offer job %s: %v", o.JobID, err)
+	}
+}
+
+// showOfferChain shows admins the waitlist of a stage and the offers made from it.
+func (a *App) showOfferChain(ctx context.Context, tgID int64, stageID string) error {
+	s, err := a.db.GetStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return a.SendText(tgID, "Этап не найден.")
+	}
+	regs, err := a.db.ListRegistrationsForStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "⏳ Лист ожидания этапа «%s»", s.Title)
+	if load, err := a.stageLoad(ctx, *s); err != nil {
+		return err
+	} else if load != "" {
+		b.WriteString("\n" + load)
+	}
+	queue := store.Queue(regs, "waitlist")
+	if len(queue) == 0 {
+		b.WriteString("\n\nВ листе ожидания никого нет.")
+	} else {
+		b.WriteString("\n")
+		for i, r := range queue {
+			fmt.Fprintf(&b, "\n%d. %s (%s)", i+1, a.pilotName(ctx, r.TgID), orDash(r.TeamName))
+		}
+	}
+
+	offers := a.offers.forStage(stageID)
+	if len(offers) == 0 {
+		b.WriteString("\n\nПредложений ещё не было.")
+	} else {
+		b.WriteString("\n\nПредложения места:")
+		for _, o := range offers {
+			fmt.Fprintf(&b, "\n• %s — %s: %s", formatWhen(o.OfferedAt, a.cfg.TimeZone), a.pilotName(ctx, o.TgID), offerStatusTitles[o.Status])
+			if o.Status == offerPending {
+				fmt.Fprintf(&b, " до %s", formatWhen(o.ExpiresAt, a.cfg.TimeZone))
+			}
+		}
+	}
+
+	msg := tgbotapi.NewMessage(tgID, b.String())
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⚙️ Статус этапа", "a:stage_status:"+stageID),
+		tgbotapi.NewInlineKeyboardButtonData("📋 Список этапов", "a:list_stages"),
+	))
+	_, err = a.bot.Send(msg)
+	return err
+}
@@ -0,0 +1,43 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"karting-bot/internal/config"
+	"karting-bot/internal/models"
+	"karting-bot/internal/scheduler"
+	"karting-bot/internal/store/memory"
+)
+
+// brokenJobs can't save the schedule.
+type brokenJobs struct{ scheduler.MemoryStore }
+
+func (brokenJobs) Save([]scheduler.Job) error { return errors.New("disk full") }
+
+func TestOfferWithoutExpiryJobGoesBack(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	s := models.Stage{StageID: "s1", Title: "Этап 1", Status: models.StageRegOpen, Capacity: "1"}
+	if err := db.CreateStage(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRegistration(ctx, models.Registration{StageID: "s1", TgID: 1, TeamName: "Молния", Role: "waitlist", PayStatus: "unpaid"}); err != nil {
+		t.Fatal(err)
+	}
+	sched, _ := scheduler.New(brokenJobs{})
+	offers, _ := newOfferLog(MemoryOfferStore{})
+	a := &App{cfg: config.Config{TeamMainLimit: 3}, db: db, sched: sched, offers: offers}
+
+	if err := a.offerFreePlaces(ctx, s); err == nil {
+		t.Fatal("offerFreePlaces succeeded without an expiry job")
+	}
+	r, _ := a.pilotRegistration(ctx, "s1", 1)
+	if r.Role != "waitlist" {
+		t.Errorf("role = %q, want waitlist", r.Role)
+	}
+	if jobs := sched.List(jobOfferExpiry); len(jobs) != 0 {
+		t.Errorf("jobs = %+v, want none", jobs)
+	}
+}
@@ -0,0 +1,171 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+)
+
+// stagePayDeadline is the payment deadline of s; a missing or broken
+// pay_deadline falls back to PAY_DEADLINE.
+func (a *App) stagePayDeadline(s models.Stage) models.PayDeadline {
+	v := strings.TrimSpace(s.PayDeadline)
+	if v == "" {
+		return a.cfg.PayDeadline
+	}
+	d, err := models.ParsePayDeadline(v)
+	if err != nil {
+		log.Printf("stage %s: pay_deadline %q: %v", s.StageID, v, err)
+		return a.cfg.PayDeadline
+	}
+	return d
+}
+
+// validatePayDeadline accepts a deadline like "48h" or "-3d", "0" for none,
+// or "-" for the default deadline.
+func validatePayDeadline(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if v == "-" {
+		return "", nil
+	}
+	if _, err := models.ParsePayDeadline(v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// payDue is when the unpaid registration r on s runs out; ok is false when
+// s has no deadline that applies to r.
+func (a *App) payDue(s models.Stage, r models.Registration) (time.Time, bool) {
+	d := a.stagePayDeadline(s)
+	if d.IsZero() {
+		return time.Time{}, false
+	}
+	created, _ := time.Parse(time.RFC3339, r.CreatedAt)
+	start, _ := s.StartsAt(a.cfg.TimeZone)
+	return d.Due(created, start)
+}
+
+// payCancelAt is when a registration due at due is cancelled after the
+// warning went out at warnedAt: the pilot always has the whole warning
+// period, even when the place came to them after the deadline, e.g. from
+// the reserve.
+func payCancelAt(due, warnedAt time.Time, warning time.Duration) time.Time {
+	if t := warnedAt.Add(warning); t.After(due) {
+		return t
+	}
+	return due
+}
+
+// payCancelTime is when the registration r due at due is cancelled, as
+// seen at now: before the warning it is counted as if warned now.
+func (a *App) payCancelTime(r models.Registration, due, now time.Time) time.Time {
+	warnedAt, ok := a.sent.at(payWarningKey(r, due))
+	if !ok {
+		warnedAt = now
+	}
+	return payCancelAt(due, warnedAt, a.cfg.PayWarning)
+}
+
+// runPayDeadlines frees unpaid main places past their deadline until ctx is done.
+func (a *App) runPayDeadlines(ctx context.Context) {
+	t := time.NewTicker(reminderInterval)
+	defer t.Stop()
+	for {
+		if err := a.checkPayDeadlines(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("pay deadlines: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkPayDeadlines warns unpaid main pilots of stages with open or closed
+// registration PAY_WARNING before their deadline, and cancels the
+// registrations of those who did not pay by then. The freed place goes to
+// the team's reserve or the waitlist.
+func (a *App) checkPayDeadlines(ctx context.Context, now time.Time) error {
+	stages, err := a.db.ListStages(ctx, true)
+	if err != nil {
+		return err
+	}
+	for _, s := range stages {
+		if s.Status != models.StageRegOpen && s.Status != models.StageRegClosed {
+			continue
+		}
+		if a.stagePayDeadline(s).IsZero() {
+			continue
+		}
+		regs, err := a.db.ListRegistrationsForStage(ctx, s.StageID)
+		if err != nil {
+			return err
+		}
+		for _, r := range regs {
+			if r.Role != "main" || r.PayStatus != "unpaid" {
+				continue
+			}
+			due, ok := a.payDue(s, r)
+			if !ok {
+				continue
+			}
+			if err := a.enforcePayDeadline(ctx, s, r, due, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *App) enforcePayDeadline(ctx context.Context, s models.Stage, r models.Registration, due, now time.Time) error {
+	cancelAt := a.payCancelTime(r, due, now)
+	if key := payWarningKey(r, due); !a.sent.has(key) {
+		if now.Before(due.Add(-a.cfg.PayWarning)) {
+			return nil
+		}
+		a.sent.mark(key)
+		msg := tgbotapi.NewMessage(r.TgID, fmt.Sprintf(
+			"💳 Участие в этапе «%s» (%s) не оплачено. Оплати до %s — иначе запись будет отменена, а место перейдёт другому пилоту.",
+			s.Title, a.stageWhen(s), formatWhen(cancelAt, a.cfg.TimeZone)))
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить", "u:pay:"+s.StageID),
+		))
+		a.notify(r.TgID, msg)
+		return nil
+	}
+	if now.Before(cancelAt) {
+		return nil
+	}
+
+	cancelled := false
+	err := a.locked(s.StageID, func() error {
+		// the pilot may have paid since the registrations were listed
+		cur, err := a.pilotRegistration(ctx, s.StageID, r.TgID)
+		if err != nil || cur == nil || cur.PayStatus != "unpaid" || cur.CreatedAt != r.CreatedAt {
+			return err
+		}
+		cancelled = true
+		return a.db.UpdatePayStatus(ctx, s.StageID, r.TgID, "cancelled")
+	})
+	if err != nil || !cancelled {
+		return err
+	}
+	log.Printf("stage %s: registration of %d cancelled, not paid by %s", s.StageID, r.TgID, due.Format(time.RFC3339))
+	a.notify(r.TgID, tgbotapi.NewMessage(r.TgID, fmt.Sprintf(
+		"⌛️ Срок оплаты вышел: запись на этап «%s» отменена, место передано другому пилоту. Если места ещё есть, можно записаться снова.", s.Title)))
+	return a.FillFreedPlace(ctx, s.StageID, r.TgID)
+}
+
+// payWarningKey includes the deadline and the registration time, so a
+// changed deadline or a new registration after a cancelled one warns again.
+func payWarningKey(r models.Registration, due time.Time) string {
+	return fmt.Sprintf("paywarn:%s:%d:%s:%d", r.StageID, due.Unix(), r.CreatedAt, r.TgID)
+}
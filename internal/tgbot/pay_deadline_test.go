@@ -0,0 +1,74 @@
+package tgbot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"karting-bot/internal/config"
+	"karting-bot/internal/models"
+	"karting-bot/internal/store/memory"
+)
+
+func TestPayCancelAt(t *testing.T) {
+	due := time.Date(2030, 6, 3, 10, 0, 0, 0, time.UTC)
+	// warned on time: the deadline holds
+	if got := payCancelAt(due, due.Add(-24*time.Hour), 24*time.Hour); !got.Equal(due) {
+		t.Errorf("cancel at %v, want %v", got, due)
+	}
+	// promoted from the reserve after the deadline: a whole warning period
+	late := due.Add(5 * 24 * time.Hour)
+	if got := payCancelAt(due, late, 24*time.Hour); !got.Equal(late.Add(24 * time.Hour)) {
+		t.Errorf("cancel at %v, want %v", got, late.Add(24*time.Hour))
+	}
+}
+
+func TestStagePayDeadline(t *testing.T) {
+	a := &App{cfg: config.Config{PayDeadline: models.PayDeadline{After: 48 * time.Hour}}}
+	cases := map[string]models.PayDeadline{
+		"":       {After: 48 * time.Hour},
+		"-3d":    {Before: 72 * time.Hour},
+		"0":      {},
+		"broken": {After: 48 * time.Hour},
+	}
+	for v, want := range cases {
+		if got := a.stagePayDeadline(models.Stage{PayDeadline: v}); got != want {
+			t.Errorf("pay_deadline %q = %+v, want %+v", v, got, want)
+		}
+	}
+	if v, err := validatePayDeadline("-"); err != nil || v != "" {
+		t.Errorf(`validatePayDeadline("-") = %q, %v; want the default`, v, err)
+	}
+	if _, err := validatePayDeadline("2 дня"); err == nil {
+		t.Error("a broken deadline was accepted")
+	}
+}
+
+// Before the warning is due nothing is sent, so the test needs no bot.
+func TestCheckPayDeadlinesWaitsForWarning(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Moscow")
+	db := memory.New()
+	ctx := context.Background()
+	created := time.Date(2030, 6, 1, 10, 0, 0, 0, loc)
+	if err := db.CreateStage(ctx, models.Stage{StageID: "s1", Title: "Этап 1", Date: "15.06.2030", Time: "10:00",
+		Status: models.StageRegOpen, PayDeadline: "48h"}); err != nil {
+		t.Fatal(err)
+	}
+	r := models.Registration{StageID: "s1", TgID: 1, Role: "main", PayStatus: "unpaid", CreatedAt: created.Format(time.RFC3339)}
+	if err := db.CreateRegistration(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := newSentLog(MemorySentStore{})
+	a := &App{cfg: config.Config{TimeZone: loc, PayWarning: 24 * time.Hour}, db: db, sent: sent}
+
+	if err := a.checkPayDeadlines(ctx, created.Add(23*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if sent.has(payWarningKey(r, created.Add(48*time.Hour))) {
+		t.Error("warning marked too early")
+	}
+	regs, _ := db.ListRegistrationsForStage(ctx, "s1")
+	if regs[0].PayStatus != "unpaid" {
+		t.Errorf("pay_status = %q, want unpaid", regs[0].PayStatus)
+	}
+}
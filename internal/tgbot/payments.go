@@ -0,0 +1,143 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/store"
+)
+
+// locked runs fn holding the lock of stageID. Everything that decides on a
+// registration's pay_status and then writes it takes the lock, so a payment
+// webhook can't slip in between. fn must not call locked again.
+func (a *App) locked(stageID string, fn func() error) error {
+	unlock := a.locks.Lock(stageID)
+	defer unlock()
+	return fn()
+}
+
+// PaymentConfirmed applies a payment for stageID that came in from the
+// provider; ref is the created_at of the registration it was made for, ""
+// when unknown. Only an unpaid registration becomes paid; applied is false
+// when the registration was cancelled before the money came, e.g. after the
+// payment deadline: the payment is refunded and admins are told. A pilot who
+// pays for an offered place accepts it.
+func (a *App) PaymentConfirmed(ctx context.Context, stageID string, tgID int64, ref string) (applied bool, err error) {
+	taken := false
+	err = a.locked(stageID, func() error {
+		r, err := a.pilotRegistration(ctx, stageID, tgID)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return fmt.Errorf("registration: %w", store.ErrNotFound)
+		}
+		if ref != "" && ref != r.CreatedAt {
+			a.paidReplacedRegistration(ctx, *r)
+			return nil
+		}
+		switch r.PayStatus {
+		case "paid":
+			// the provider delivered the webhook again
+			applied = true
+			return nil
+		case "cancelled":
+			return a.refundLatePayment(ctx, *r)
+		}
+		if err := a.db.UpdatePayStatus(ctx, stageID, tgID, "paid"); err != nil {
+			return err
+		}
+		applied = true
+		// paying for an offered place accepts it
+		taken, err = a.takeOffer(ctx, stageID, tgID)
+		return err
+	})
+	if taken {
+		a.notify(tgID, tgbotapi.NewMessage(tgID, "✅ Место из листа ожидания твоё: ты в основном составе."))
+	}
+	return applied, err
+}
+
+// PaymentCancelled applies a cancelled payment from the provider: the
+// registration is cancelled and the place it held is filled. applied is
+// false when ref, like in PaymentConfirmed, names a registration the pilot
+// has since replaced: the current one is left as it is.
+func (a *App) PaymentCancelled(ctx context.Context, stageID string, tgID int64, ref string) (applied bool, err error) {
+	cancelled := false
+	err = a.locked(stageID, func() error {
+		r, err := a.pilotRegistration(ctx, stageID, tgID)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return fmt.Errorf("registration: %w", store.ErrNotFound)
+		}
+		if ref != "" && ref != r.CreatedAt {
+			return nil
+		}
+		applied = true
+		if r.PayStatus == "cancelled" {
+			return nil
+		}
+		cancelled = true
+		return a.db.UpdatePayStatus(ctx, stageID, tgID, "cancelled")
+	})
+	if err != nil || !cancelled {
+		return applied, err
+	}
+	return applied, a.FillFreedPlace(ctx, stageID, tgID)
+}
+
+// paidReplacedRegistration tells admins about a payment for an earlier
+// registration of r's pilot, cancelled and replaced by r since. It doesn't
+// pay for r; whether the money goes back is up to admins, who see the old
+// registration and its refund state in the table.
+func (a *App) paidReplacedRegistration(ctx context.Context, r models.Registration) {
+	title := r.StageID
+	if s, err := a.db.GetStage(ctx, r.StageID); err == nil && s != nil {
+		title = s.Title
+	}
+	log.Printf("stage %s: payment of %d for a registration replaced by the one of %s", r.StageID, r.TgID, r.CreatedAt)
+	a.tellAdmins(fmt.Sprintf("⚠️ Оплата по прежней, отменённой записи: %s, этап «%s». Пилот записался заново, новую запись эта оплата не закрывает. Проверь возврат по старой записи.",
+		a.pilotLabel(ctx, r.TgID), title))
+}
+
+// refundLatePayment returns a payment for the cancelled registration r: its
+// place may be taken already. A registration refunded before is left to
+// admins, since the webhook may be a redelivery of the original payment.
+func (a *App) refundLatePayment(ctx context.Context, r models.Registration) error {
+	s, err := a.db.GetStage(ctx, r.StageID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("stage: %w", store.ErrNotFound)
+	}
+	if r.Refund == refundRequested {
+		log.Printf("stage %s: payment of %d for a cancelled registration, refund was requested before", s.StageID, r.TgID)
+		a.tellAdmins(fmt.Sprintf("⚠️ Оплата по отменённой записи: %s, этап «%s». Возврат по этой записи уже запрашивался — проверь, не заплатил ли пилот дважды.",
+			a.pilotLabel(ctx, r.TgID), s.Title))
+		return nil
+	}
+
+	r.Refund = a.requestRefund(ctx, *s, r)
+	if err := a.db.UpdateRefund(ctx, r.StageID, r.TgID, r.Refund); err != nil {
+		return err
+	}
+	log.Printf("stage %s: payment of %d came after the registration was cancelled, refund %s", s.StageID, r.TgID, r.Refund)
+	text := fmt.Sprintf("Оплата пришла, но запись на этап «%s» к этому времени уже отменена.", s.Title)
+	if r.Refund == refundRequested {
+		text += " Мы запросили возврат денег."
+		a.tellAdmins(fmt.Sprintf("ℹ️ Оплата после отмены записи: %s, этап «%s». Возврат запрошен.", a.pilotLabel(ctx, r.TgID), s.Title))
+	} else {
+		text += " Организатор вернёт деньги вручную."
+		a.tellAdmins(fmt.Sprintf("⚠️ Оплата после отмены записи: %s, этап «%s», оплата %s. Автоматический возврат не прошёл, верни вручную.",
+			a.pilotLabel(ctx, r.TgID), s.Title, s.Price))
+	}
+	a.notify(r.TgID, tgbotapi.NewMessage(r.TgID, text))
+	return nil
+}
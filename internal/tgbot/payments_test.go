@@ -0,0 +1,166 @@
+package tgbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"karting-bot/internal/config"
+	"karting-bot/internal/models"
+	"karting-bot/internal/payments/stub"
+	"karting-bot/internal/scheduler"
+	"karting-bot/internal/store"
+	"karting-bot/internal/store/memory"
+)
+
+// No case here tells the pilot anything, so the test needs no bot.
+func TestPaymentConfirmedOnlyPaysUnpaid(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	if err := db.CreateStage(ctx, models.Stage{StageID: "s1", Title: "Этап 1", Status: models.StageRegOpen}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []models.Registration{
+		{StageID: "s1", TgID: 1, Role: "main", PayStatus: "unpaid"},
+		{StageID: "s1", TgID: 2, Role: "main", PayStatus: "paid"},
+		{StageID: "s1", TgID: 3, Role: "main", PayStatus: "cancelled", Refund: refundRequested},
+	} {
+		if err := db.CreateRegistration(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offers, _ := newOfferLog(MemoryOfferStore{})
+	a := &App{db: db, offers: offers}
+
+	want := map[int64]struct {
+		applied bool
+		status  string
+	}{
+		1: {true, "paid"},
+		2: {true, "paid"}, // a redelivered webhook
+		3: {false, "cancelled"},
+	}
+	for id, w := range want {
+		applied, err := a.PaymentConfirmed(ctx, "s1", id, "")
+		if err != nil {
+			t.Fatalf("pilot %d: %v", id, err)
+		}
+		r, _ := a.pilotRegistration(ctx, "s1", id)
+		if applied != w.applied || r.PayStatus != w.status {
+			t.Errorf("pilot %d: applied %v, pay_status %q; want %v, %q", id, applied, r.PayStatus, w.applied, w.status)
+		}
+	}
+}
+
+// A payment accepts the offer, and the expiry job that fires afterwards has
+// nothing left to do.
+func TestPaymentAcceptsOfferBeforeExpiry(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	if err := db.CreateRegistration(ctx, models.Registration{StageID: "s1", TgID: 1, Role: "offered", PayStatus: "unpaid"}); err != nil {
+		t.Fatal(err)
+	}
+	offers, _ := newOfferLog(MemoryOfferStore{})
+	offers.add(WaitlistOffer{StageID: "s1", TgID: 1, Status: offerPending, JobID: "j1"})
+	sched, _ := scheduler.New(scheduler.MemoryStore{})
+	bot, tg := newTestBot(t)
+	a := &App{db: db, bot: bot, offers: offers, sched: sched}
+
+	applied, err := a.PaymentConfirmed(ctx, "s1", 1, "")
+	if err != nil || !applied {
+		t.Fatalf("PaymentConfirmed = %v, %v; want applied", applied, err)
+	}
+	if err := a.runOfferExpiry(ctx, scheduler.Job{Data: map[string]string{"stage_id": "s1", "tg_id": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := a.pilotRegistration(ctx, "s1", 1)
+	if r.Role != "main" || r.PayStatus != "paid" {
+		t.Errorf("registration = %s/%s, want main/paid", r.Role, r.PayStatus)
+	}
+	if got := offers.forStage("s1"); len(got) != 1 || got[0].Status != offerAccepted {
+		t.Errorf("offers = %+v, want one accepted", got)
+	}
+	if sent := tg.to(1); len(sent) != 1 || !strings.Contains(sent[0], "основном составе") {
+		t.Errorf("pilot was sent %q, want the accepted place only", sent)
+	}
+}
+
+// A payment that comes after the offer expired is refunded, and the place
+// stays with the next pilot.
+func TestPaymentAfterOfferExpiryIsRefunded(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	if err := db.CreateStage(ctx, models.Stage{StageID: "s1", Title: "Этап 1", Price: "1500", Status: models.StageRegOpen}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRegistration(ctx, models.Registration{StageID: "s1", TgID: 1, Role: "offered", PayStatus: "unpaid"}); err != nil {
+		t.Fatal(err)
+	}
+	offers, _ := newOfferLog(MemoryOfferStore{})
+	offers.add(WaitlistOffer{StageID: "s1", TgID: 1, Status: offerPending, JobID: "j1"})
+	sched, _ := scheduler.New(scheduler.MemoryStore{})
+	bot, tg := newTestBot(t)
+	a := &App{cfg: config.Config{TeamMainLimit: 3, AdminTGIDs: map[int64]bool{100: true}},
+		db: db, bot: bot, pay: stub.New("secret", ""), offers: offers, sched: sched}
+
+	if err := a.runOfferExpiry(ctx, scheduler.Job{Data: map[string]string{"stage_id": "s1", "tg_id": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := a.PaymentConfirmed(ctx, "s1", 1, "")
+	if err != nil || applied {
+		t.Fatalf("PaymentConfirmed = %v, %v; want not applied", applied, err)
+	}
+	r, _ := a.pilotRegistration(ctx, "s1", 1)
+	if r.PayStatus != "cancelled" || r.Refund != refundRequested {
+		t.Errorf("registration = %s, refund %q; want cancelled, refund requested", r.PayStatus, r.Refund)
+	}
+	if got := offers.forStage("s1"); len(got) != 1 || got[0].Status != offerExpired {
+		t.Errorf("offers = %+v, want one expired", got)
+	}
+	if len(tg.to(100)) != 1 {
+		t.Errorf("admin was sent %q, want one report", tg.to(100))
+	}
+}
+
+// A payment made before the pilot cancelled and registered again doesn't pay
+// for the new registration, even when it comes after it.
+func TestPaymentForReplacedRegistration(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	if err := db.CreateStage(ctx, models.Stage{StageID: "s1", Title: "Этап 1", Status: models.StageRegOpen}); err != nil {
+		t.Fatal(err)
+	}
+	old := models.Registration{StageID: "s1", TgID: 1, TeamName: "Молния", PayStatus: "unpaid", CreatedAt: "2026-05-01T10:00:00+03:00"}
+	if _, err := db.RegisterForStage(ctx, old, store.Limits{TeamMain: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdatePayStatus(ctx, "s1", 1, "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	cur := old
+	cur.CreatedAt = "2026-05-02T10:00:00+03:00"
+	if _, err := db.RegisterForStage(ctx, cur, store.Limits{TeamMain: 3}); err != nil {
+		t.Fatal(err)
+	}
+	bot, tg := newTestBot(t)
+	offers, _ := newOfferLog(MemoryOfferStore{})
+	a := &App{cfg: config.Config{AdminTGIDs: map[int64]bool{100: true}}, db: db, bot: bot, offers: offers}
+
+	if applied, err := a.PaymentConfirmed(ctx, "s1", 1, old.CreatedAt); err != nil || applied {
+		t.Fatalf("PaymentConfirmed = %v, %v; want not applied", applied, err)
+	}
+	if applied, err := a.PaymentCancelled(ctx, "s1", 1, old.CreatedAt); err != nil || applied {
+		t.Fatalf("PaymentCancelled = %v, %v; want not applied", applied, err)
+	}
+	r, _ := a.pilotRegistration(ctx, "s1", 1)
+	if r.CreatedAt != cur.CreatedAt || r.PayStatus != "unpaid" {
+		t.Errorf("registration = %+v, want the new one unpaid", r)
+	}
+	if len(tg.to(100)) != 1 {
+		t.Errorf("admin was sent %q, want one report", tg.to(100))
+	}
+
+	if applied, err := a.PaymentConfirmed(ctx, "s1", 1, cur.CreatedAt); err != nil || !applied {
+		t.Fatalf("payment for the new registration = %v, %v; want applied", applied, err)
+	}
+}
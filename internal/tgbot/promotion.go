@@ -0,0 +1,150 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+)
+
+// FillFreedPlace is called after the registration of tgID on stageID was
+// cancelled. When the pilot held a place, the earliest reserve of the same
+// team takes it, and both pilots and the team are told; without a reserve
+// the place is offered to the waitlist. Only a failed store call is
+// returned: notifications are best effort.
+func (a *App) FillFreedPlace(ctx context.Context, stageID string, tgID int64) error {
+	regs, err := a.db.ListRegistrationsForStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	var dropped *models.Registration
+	for i := range regs {
+		if regs[i].TgID == tgID {
+			dropped = &regs[i]
+		}
+	}
+	if dropped == nil || !(dropped.Role == "main" || dropped.Role == "offered") {
+		return nil
+	}
+	if dropped.Role == "offered" {
+		a.closeOffer(stageID, tgID, offerDeclined)
+	}
+	s, err := a.db.GetStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	if s == nil || s.Status == models.StageCancelled || s.Status == models.StageFinished {
+		return nil
+	}
+
+	if dropped.Role == "main" {
+		promoted, err := a.db.PromoteReserve(ctx, stageID, dropped.TeamName, a.stageLimits(*s))
+		if err != nil {
+			return err
+		}
+		if promoted != nil {
+			log.Printf("stage %s: reserve %d promoted to main in team %q after %d dropped out",
+				stageID, promoted.TgID, promoted.TeamName, tgID)
+			a.notifyPromotion(ctx, *s, *dropped, *promoted)
+		}
+	}
+	return a.offerFreePlaces(ctx, *s)
+}
+
+// promoteReserves moves reserves to main while their teams and the stage
+// have room, e.g. after the team limit or the capacity of s was raised.
+// Like FillFreedPlace, it is done before the waitlist gets the places.
+func (a *App) promoteReserves(ctx context.Context, s models.Stage) error {
+	if s.Status != models.StageRegOpen && s.Status != models.StageRegClosed {
+		return nil
+	}
+	regs, err := a.db.ListRegistrationsForStage(ctx, s.StageID)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, r := range regs {
+		team := strings.ToLower(strings.TrimSpace(r.TeamName))
+		if r.Role != "reserve" || r.PayStatus == "cancelled" || seen[team] {
+			continue
+		}
+		seen[team] = true
+		for {
+			promoted, err := a.db.PromoteReserve(ctx, s.StageID, r.TeamName, a.stageLimits(s))
+			if err != nil {
+				return err
+			}
+			if promoted == nil {
+				break
+			}
+			log.Printf("stage %s: reserve %d promoted to main in team %q, the stage has more places", s.StageID, promoted.TgID, promoted.TeamName)
+			a.notify(promoted.TgID, a.promotionMessage(s, *promoted, fmt.Sprintf(
+				"🎉 На этапе «%s» (%s) стало больше мест: ты переведён из резерва в основной состав команды %s.",
+				s.Title, a.stageWhen(s), promoted.TeamName)))
+		}
+	}
+	return nil
+}
+
+// promotionMessage tells the promoted pilot text, with a reminder to pay
+// when they haven't yet.
+func (a *App) promotionMessage(s models.Stage, promoted models.Registration, text string) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(promoted.TgID, text)
+	if promoted.PayStatus == "unpaid" {
+		msg.Text += "\n\nНе забудь оплатить участие."
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить", "u:pay:"+s.StageID),
+		))
+	}
+	return msg
+}
+
+func (a *App) notifyPromotion(ctx context.Context, s models.Stage, dropped, promoted models.Registration) {
+	promotedName := a.pilotName(ctx, promoted.TgID)
+	droppedName := a.pilotName(ctx, dropped.TgID)
+
+	a.notify(promoted.TgID, a.promotionMessage(s, promoted, fmt.Sprintf(
+		"🎉 Освободилось место: на этапе «%s» (%s) ты переведён из резерва в основной состав команды %s.",
+		s.Title, a.stageWhen(s), promoted.TeamName)))
+
+	a.notify(dropped.TgID, tgbotapi.NewMessage(dropped.TgID, fmt.Sprintf(
+		"Твоё место в основном составе на этапе «%s» передано резервному пилоту команды — %s.", s.Title, promotedName)))
+
+	ps, err := a.db.ListParticipants(ctx)
+	if err != nil {
+		log.Printf("notify team %q: %v", promoted.TeamName, err)
+		return
+	}
+	team := fmt.Sprintf("🔄 Команда %s, этап «%s»: %s выбыл(а) из основного состава, его место занял(а) %s (из резерва).",
+		promoted.TeamName, s.Title, droppedName, promotedName)
+	for _, p := range ps {
+		if p.TgID == promoted.TgID || p.TgID == dropped.TgID ||
+			!strings.EqualFold(strings.TrimSpace(p.TeamName), strings.TrimSpace(promoted.TeamName)) {
+			continue
+		}
+		a.notify(p.TgID, tgbotapi.NewMessage(p.TgID, team))
+	}
+}
+
+// notify sends msg and only logs a failure: the pilot may have blocked the bot.
+func (a *App) notify(tgID int64, msg tgbotapi.Chattable) {
+	if _, err := a.bot.Send(msg); err != nil {
+		log.Printf("notify %d: %v", tgID, err)
+	}
+}
+
+// pilotName is the nick of a pilot, or the name when there is no nick.
+func (a *App) pilotName(ctx context.Context, tgID int64) string {
+	p, err := a.db.GetParticipant(ctx, tgID)
+	if err != nil || p == nil {
+		return fmt.Sprintf("пилот %d", tgID)
+	}
+	if p.Nick != "" {
+		return p.Nick
+	}
+	return strings.TrimSpace(p.FirstName + " " + p.LastName)
+}
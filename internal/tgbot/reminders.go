@@ -0,0 +1,176 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+)
+
+// reminderInterval is how often stages are checked for due reminders.
+const reminderInterval = time.Minute
+
+// runReminders sends stage reminders until ctx is done.
+func (a *App) runReminders(ctx context.Context) {
+	if len(a.cfg.ReminderOffsets) == 0 {
+		return
+	}
+	t := time.NewTicker(reminderInterval)
+	defer t.Stop()
+	for {
+		if err := a.sendReminders(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("reminders: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// sendReminders reminds registered pilots of stages that start within one of
+// the configured offsets. Each pilot gets the reminder of the smallest offset
+// that is due, once; a pilot who registered after a reminder was due does
+// not get it.
+func (a *App) sendReminders(ctx context.Context, now time.Time) error {
+	offsets := append([]time.Duration(nil), a.cfg.ReminderOffsets...)
+	sort.Slice(offsets, func(i, k int) bool { return offsets[i] < offsets[k] })
+	maxOffset := offsets[len(offsets)-1]
+
+	stages, err := a.db.ListStages(ctx, true)
+	if err != nil {
+		return err
+	}
+	for _, s := range stages {
+		if !stageReminded(s) {
+			continue
+		}
+		start, ok := s.StartsAt(a.cfg.TimeZone)
+		if !ok || !now.Before(start) || now.Before(start.Add(-maxOffset)) {
+			continue
+		}
+		regs, err := a.db.ListRegistrationsForStage(ctx, s.StageID)
+		if err != nil {
+			return err
+		}
+		for _, r := range regs {
+			if r.PayStatus == "cancelled" {
+				continue
+			}
+			if err := a.remind(ctx, s, start, r, offsets, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *App) remind(ctx context.Context, s models.Stage, start time.Time, r models.Registration, offsets []time.Duration, now time.Time) error {
+	due := []string{}
+	var offset time.Duration
+	for _, off := range offsets {
+		if now.Before(start.Add(-off)) {
+			continue
+		}
+		if len(due) == 0 {
+			offset = off
+		}
+		due = append(due, reminderKey(s.StageID, start, off, r.TgID))
+	}
+	if len(due) == 0 || a.sent.has(due[0]) {
+		return nil
+	}
+	// marked first: a reminder that failed to send is not worth a second try
+	a.sent.mark(due...)
+
+	if created, err := time.Parse(time.RFC3339, r.CreatedAt); err == nil && created.After(start.Add(-offset)) {
+		// registered when the reminder was already due: no news for them
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(broadcastInterval):
+	}
+	if _, err := a.bot.Send(a.reminderMessage(s, start, r, now)); err != nil {
+		outcome, _ := classifySendError(err)
+		if outcome == sendFailed {
+			log.Printf("reminder %s to %d: %v", s.StageID, r.TgID, err)
+		}
+	}
+	return nil
+}
+
+// reminderKey includes the start, so moving a stage brings its reminders back.
+func reminderKey(stageID string, start time.Time, offset time.Duration, tgID int64) string {
+	return fmt.Sprintf("remind:%s:%d:%s:%d", stageID, start.Unix(), offset, tgID)
+}
+
+func (a *App) reminderMessage(s models.Stage, start time.Time, r models.Registration, now time.Time) tgbotapi.MessageConfig {
+	var b strings.Builder
+	fmt.Fprintf(&b, "⏰ Напоминание: этап «%s» %s — %s.\n", s.Title, untilText(start.Sub(now)), formatWhen(start, a.cfg.TimeZone))
+	if place := joinPlace(s); place != "" {
+		fmt.Fprintf(&b, "📍 %s\n", place)
+	}
+	switch r.Role {
+	case "main":
+		b.WriteString("Ты в основном составе.\n")
+	case "waitlist":
+		b.WriteString("Ты в листе ожидания: если освободится место, бот напишет.\n")
+	case "offered":
+		b.WriteString("Тебе предложено место из листа ожидания — ответь на сообщение бота.\n")
+	default:
+		b.WriteString("Ты в резерве: если освободится место, бот напишет.\n")
+	}
+
+	msg := tgbotapi.NewMessage(r.TgID, b.String())
+	if r.PayStatus == "unpaid" && (r.Role == "main" || r.Role == "reserve") {
+		msg.Text += "\n💳 Участие ещё не оплачено."
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить", "u:pay:"+s.StageID),
+		))
+	}
+	return msg
+}
+
+// untilText says "через 3 дня" for d, rounded to whole days, hours or minutes.
+func untilText(d time.Duration) string {
+	return "через " + durationText(d)
+}
+
+// durationText rounds d to days, hours or minutes: "3 дня", "5 часов".
+func durationText(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		n := int((d + 12*time.Hour) / (24 * time.Hour))
+		return fmt.Sprintf("%d %s", n, plural(n, "день", "дня", "дней"))
+	case d >= time.Hour:
+		n := int((d + 30*time.Minute) / time.Hour)
+		return fmt.Sprintf("%d %s", n, plural(n, "час", "часа", "часов"))
+	default:
+		n := int((d + 30*time.Second) / time.Minute)
+		return fmt.Sprintf("%d %s", n, plural(n, "минуту", "минуты", "минут"))
+	}
+}
+
+// plural picks the Russian form for n: 1 день, 2 дня, 5 дней.
+func plural(n int, one, few, many string) string {
+	n %= 100
+	if n >= 11 && n <= 14 {
+		return many
+	}
+	switch n % 10 {
+	case 1:
+		return one
+	case 2, 3, 4:
+		return few
+	}
+	return many
+}
@@ -0,0 +1,64 @@
+package tgbot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"karting-bot/internal/config"
+	"karting-bot/internal/models"
+	"karting-bot/internal/store/memory"
+)
+
+func TestUntilText(t *testing.T) {
+	cases := map[time.Duration]string{
+		72 * time.Hour:                "через 3 дня",
+		71*time.Hour + 59*time.Minute: "через 3 дня",
+		3 * time.Hour:                 "через 3 часа",
+		21 * time.Hour:                "через 21 час",
+		5 * time.Hour:                 "через 5 часов",
+		11 * time.Minute:              "через 11 минут",
+	}
+	for d, want := range cases {
+		if got := untilText(d); got != want {
+			t.Errorf("untilText(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+// With no due reminders nothing is sent, so the test needs no bot.
+func TestSendRemindersMarksOnlyDue(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Moscow")
+	db := memory.New()
+	ctx := context.Background()
+	start := time.Date(2030, 6, 15, 10, 0, 0, 0, loc)
+	if err := db.CreateStage(ctx, models.Stage{StageID: "s1", Title: "Этап 1", Date: "15.06.2030", Time: "10:00"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRegistration(ctx, models.Registration{StageID: "s1", TgID: 1, Role: "main", PayStatus: "paid",
+		CreatedAt: start.Add(-24 * time.Hour).Format(time.RFC3339)}); err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := newSentLog(MemorySentStore{})
+	a := &App{cfg: config.Config{TimeZone: loc, ReminderOffsets: []time.Duration{72 * time.Hour, 3 * time.Hour}}, db: db, sent: sent}
+
+	// before any offset: nothing to do
+	if err := a.sendReminders(ctx, start.Add(-100*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if sent.has(reminderKey("s1", start, 72*time.Hour, 1)) {
+		t.Fatal("reminder marked too early")
+	}
+
+	// the pilot registered a day before the start, after the 72h reminder
+	// was due: it is marked as done without sending
+	if err := a.sendReminders(ctx, start.Add(-20*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if !sent.has(reminderKey("s1", start, 72*time.Hour, 1)) {
+		t.Error("72h reminder not marked")
+	}
+	if sent.has(reminderKey("s1", start, 3*time.Hour, 1)) {
+		t.Error("3h reminder marked too early")
+	}
+}
@@ -0,0 +1,167 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/scheduler"
+	"karting-bot/internal/util"
+)
+
+// jobBroadcast is the scheduler job kind of a scheduled broadcast. Its Data
+// holds the broadcast flow answers; the audience is resolved when it runs.
+const jobBroadcast = "broadcast"
+
+// broadcastKeys are the broadcast flow answers kept in a scheduled job.
+var broadcastKeys = []string{"audience", "target", "text", "media", "buttons"}
+
+func (a *App) handleBroadcastSchedule(ctx context.Context, tgID int64, _ string) error {
+	return a.answerButton(ctx, tgID, "admin_broadcast", "confirm", "schedule")
+}
+
+// scheduleBroadcast takes the answer of the "when" step and puts the broadcast
+// in the scheduler, or moves the one being edited.
+func (a *App) scheduleBroadcast(ctx context.Context, tgID int64, txt string, st UserState) error {
+	at, err := util.ParseDateTime(txt, a.cfg.TimeZone, time.Now())
+	if err != nil {
+		return a.SendText(tgID, "⚠️ "+err.Error()+"\nВведи ещё раз:")
+	}
+	if !at.After(time.Now()) {
+		return a.SendText(tgID, "⚠️ Это время уже прошло. Введи ещё раз:")
+	}
+
+	data := map[string]string{}
+	for _, k := range broadcastKeys {
+		data[k] = st.Data[k]
+	}
+	j := scheduler.Job{Kind: jobBroadcast, RunAt: at, Data: data, CreatedBy: tgID}
+	if id := st.Data["edit_id"]; id != "" {
+		old, ok := a.sched.Get(id)
+		if ok {
+			j.ID, j.CreatedAt = id, old.CreatedAt
+			err = a.sched.Update(j)
+		}
+		if !ok || errors.Is(err, scheduler.ErrNotFound) {
+			// it went out while being edited; keep the edit as a new one
+			_, err = a.sched.Add(j)
+		}
+	} else {
+		_, err = a.sched.Add(j)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.state.set(tgID, UserState{})
+	msg := tgbotapi.NewMessage(tgID, "🕒 Рассылка запланирована на "+formatWhen(at, a.cfg.TimeZone)+".")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🕒 Запланированные", "a:sched_list"),
+		tgbotapi.NewInlineKeyboardButtonData("🛠 Админ-панель", "a:menu"),
+	))
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+// runScheduledBroadcast is the scheduler handler of jobBroadcast. The
+// broadcast goes out even when its admin can't be reached any more.
+func (a *App) runScheduledBroadcast(ctx context.Context, j scheduler.Job) error {
+	a.notify(j.CreatedBy, tgbotapi.NewMessage(j.CreatedBy, "🕒 Запускаю запланированную рассылку."))
+	return a.launchBroadcast(ctx, j.CreatedBy, j.Data)
+}
+
+func (a *App) showScheduled(ctx context.Context, tgID int64, _ string) error {
+	jobs := a.sched.List(jobBroadcast)
+	if len(jobs) == 0 {
+		msg := tgbotapi.NewMessage(tgID, "Запланированных рассылок нет.")
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🛠 Админ-панель", "a:menu"),
+		))
+		_, err := a.bot.Send(msg)
+		return err
+	}
+
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, j := range jobs {
+		label, err := a.audienceLabel(ctx, j.Data)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(formatWhen(j.RunAt, a.cfg.TimeZone)+" — "+truncate(label, 30), "a:sched_open:"+j.ID),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🛠 Админ-панель", "a:menu"),
+	))
+	msg := tgbotapi.NewMessage(tgID, "🕒 Запланированные рассылки:")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err := a.bot.Send(msg)
+	return err
+}
+
+func (a *App) openScheduled(ctx context.Context, tgID int64, id string) error {
+	j, ok := a.sched.Get(id)
+	if !ok {
+		if err := a.SendText(tgID, "Этой рассылки уже нет в расписании."); err != nil {
+			return err
+		}
+		return a.showScheduled(ctx, tgID, "")
+	}
+	label, err := a.audienceLabel(ctx, j.Data)
+	if err != nil {
+		return err
+	}
+	p, err := a.db.GetParticipant(ctx, tgID)
+	if err != nil {
+		return err
+	}
+	if _, err := a.bot.Send(broadcastMessage(tgID, broadcastContent(j.Data), p)); err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewMessage(tgID, fmt.Sprintf("👆 Запланированная рассылка\n\nКогда: %s\nКому: %s",
+		formatWhen(j.RunAt, a.cfg.TimeZone), label))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Изменить", "a:sched_edit:"+j.ID),
+			tgbotapi.NewInlineKeyboardButtonData("🗑 Удалить", "a:sched_del:"+j.ID),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⬅️ К списку", "a:sched_list"),
+		),
+	)
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+// editScheduled walks the broadcast flow again with the saved answers, so
+// every step can be kept or changed.
+func (a *App) editScheduled(ctx context.Context, tgID int64, id string) error {
+	j, ok := a.sched.Get(id)
+	if !ok {
+		return a.SendText(tgID, "Этой рассылки уже нет в расписании.")
+	}
+	data := map[string]string{"edit_id": j.ID, "when": formatWhen(j.RunAt, a.cfg.TimeZone)}
+	for _, k := range broadcastKeys {
+		data[k] = j.Data[k]
+	}
+	return a.startFlow(ctx, tgID, "admin_broadcast", data)
+}
+
+func (a *App) deleteScheduled(ctx context.Context, tgID int64, id string) error {
+	if err := a.sched.Remove(id); err != nil && !errors.Is(err, scheduler.ErrNotFound) {
+		return err
+	}
+	if err := a.SendText(tgID, "🗑 Рассылка удалена из расписания."); err != nil {
+		return err
+	}
+	return a.showScheduled(ctx, tgID, "")
+}
+
+func formatWhen(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(util.DateTimeLayout)
+}
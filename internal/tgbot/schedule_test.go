@@ -0,0 +1,41 @@
+package tgbot
+
+import (
+	"context"
+	"testing"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/scheduler"
+	"karting-bot/internal/store/memory"
+)
+
+// A scheduled broadcast goes out even when its admin blocked the bot since.
+func TestScheduledBroadcastWithoutAdmin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := memory.New()
+	for _, id := range []int64{1, 2} {
+		if err := db.CreateParticipant(ctx, models.Participant{TgID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bot, tg := newTestBot(t)
+	tg.blocked[100] = true
+	a := &App{db: db, bot: bot}
+	var err error
+	if a.broadcasts, err = newBroadcaster(a, MemoryBroadcastStore{}); err != nil {
+		t.Fatal(err)
+	}
+	a.broadcasts.start(ctx)
+
+	j := scheduler.Job{Kind: jobBroadcast, CreatedBy: 100, Data: map[string]string{"audience": audienceAll, "text": "Привет"}}
+	if err := a.runScheduledBroadcast(ctx, j); err != nil {
+		t.Fatal(err)
+	}
+	a.broadcasts.wait()
+	for _, id := range []int64{1, 2} {
+		if len(tg.to(id)) != 1 {
+			t.Errorf("pilot %d got %q, want the broadcast", id, tg.to(id))
+		}
+	}
+}
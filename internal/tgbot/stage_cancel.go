@@ -0,0 +1,258 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+)
+
+// Refund states of a cancelled registration.
+const (
+	refundRequested = "requested"
+	refundFailed    = "failed"
+)
+
+// stageCancelReport is what the admin learns after cancelling a stage.
+type stageCancelReport struct {
+	Cancelled int // registrations cancelled now
+	Main      int
+	Reserve   int
+	Waitlist  int
+	Offered   int // waitlisted pilots a free place was offered to
+	Paid      int // of them paid, refund attempted
+	Refunded  int // refund requested from the provider
+	Failed    []models.Registration
+	Notify    []int64 // pilots to tell about the cancellation
+}
+
+func (a *App) askStageCancelConfirm(ctx context.Context, tgID int64, st UserState) error {
+	s, err := a.db.GetStage(ctx, st.Data["stage_id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		a.state.set(tgID, UserState{})
+		return a.SendText(tgID, "Этап не найден. /admin")
+	}
+	regs, err := a.db.ListRegistrationsForStage(ctx, s.StageID)
+	if err != nil {
+		return err
+	}
+	active, paid := 0, 0
+	for _, r := range regs {
+		if r.PayStatus == "cancelled" {
+			continue
+		}
+		active++
+		if r.PayStatus == "paid" {
+			paid++
+		}
+	}
+	text := fmt.Sprintf("❌ Отменить этап «%s» (%s)?\n\nПричина: %s\n\nЗаписей: %d, из них оплачено: %d — по ним будет запрошен возврат.\nВсе записанные пилоты получат уведомление. Отменить это действие нельзя.",
+		s.Title, a.stageWhen(*s), st.Data["reason"], active, paid)
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("❌ Да, отменить этап", "a:cancel_stage:yes"),
+		),
+		flowNavRow(st),
+	)
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+func (a *App) handleAdminCancelStageFlow(ctx context.Context, tgID int64, txt string, st UserState) error {
+	if flowSteps[st.Flow][st.Step-1].key != "reason" {
+		// the cancellation is confirmed with a button
+		return a.askStep(ctx, tgID, st)
+	}
+	if ok, err := a.answerStep(tgID, txt, &st); !ok {
+		return err
+	}
+	return a.nextStep(ctx, tgID, st)
+}
+
+// handleStageCancel cancels the stage of the confirmed admin_cancel_stage flow:
+// registrations are cancelled, paid ones refunded, and pilots notified.
+func (a *App) handleStageCancel(ctx context.Context, tgID int64, _ string) error {
+	st, ok := a.flowAt(tgID, "admin_cancel_stage", "confirm")
+	if !ok {
+		return a.SendText(tgID, "Этот шаг уже неактуален. /admin")
+	}
+	a.state.set(tgID, UserState{})
+	s, err := a.db.GetStage(ctx, st.Data["stage_id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return a.SendText(tgID, "Этап не найден.")
+	}
+	if !models.CanMoveStage(s.Status, models.StageCancelled) {
+		return a.SendText(tgID, fmt.Sprintf("⚠️ Этап в статусе «%s», отменить его нельзя.", stageStatusTitle(s.Status)))
+	}
+
+	reason := st.Data["reason"]
+	log.Printf("stage %s: cancelled by %d: %s", s.StageID, tgID, reason)
+	if s.Status == models.StageRegOpen {
+		// nobody joins while the registrations are cancelled
+		s.SetStatus(models.StageRegClosed)
+		if err := a.db.UpdateStage(ctx, *s); err != nil {
+			return err
+		}
+	}
+	rep, err := a.cancelStageRegistrations(ctx, *s)
+	if err != nil {
+		return err
+	}
+	// the status goes after the registrations: if something failed above,
+	// the admin can cancel again
+	s.SetStatus(models.StageCancelled)
+	if err := a.db.UpdateStage(ctx, *s); err != nil {
+		return err
+	}
+	// a join that passed the status check before registration closed
+	late, err := a.cancelStageRegistrations(ctx, *s)
+	if err != nil {
+		return err
+	}
+	rep.add(late)
+
+	if err := a.SendText(tgID, a.stageCancelSummary(ctx, *s, reason, rep)); err != nil {
+		return err
+	}
+	if len(rep.Notify) == 0 {
+		return nil
+	}
+	notice := fmt.Sprintf("❌ Этап «%s» (%s) отменён.\n\nПричина: %s\n\nТвоя запись отменена. Если участие было оплачено, мы уже запросили возврат денег.",
+		s.Title, a.stageWhen(*s), reason)
+	return a.startBroadcastJob(tgID, "отмена этапа «"+s.Title+"»", BroadcastJob{Text: notice}, rep.Notify)
+}
+
+// cancelStageRegistrations cancels every active registration of s and asks
+// the payment provider to refund the paid ones. A registration whose refund
+// was requested already is not refunded twice.
+func (a *App) cancelStageRegistrations(ctx context.Context, s models.Stage) (stageCancelReport, error) {
+	// a payment coming in meanwhile waits, and is refunded as a late one
+	unlock := a.locks.Lock(s.StageID)
+	defer unlock()
+	var rep stageCancelReport
+	regs, err := a.db.ListRegistrationsForStage(ctx, s.StageID)
+	if err != nil {
+		return rep, err
+	}
+	seen := map[int64]bool{}
+	for _, r := range regs {
+		if r.PayStatus == "cancelled" {
+			continue
+		}
+		if r.PayStatus == "paid" {
+			rep.Paid++
+			if r.Refund != refundRequested {
+				r.Refund = a.requestRefund(ctx, s, r)
+				if err := a.db.UpdateRefund(ctx, r.StageID, r.TgID, r.Refund); err != nil {
+					return rep, err
+				}
+			}
+			if r.Refund == refundRequested {
+				rep.Refunded++
+			} else {
+				rep.Failed = append(rep.Failed, r)
+			}
+		}
+		if err := a.db.UpdatePayStatus(ctx, r.StageID, r.TgID, "cancelled"); err != nil {
+			return rep, err
+		}
+		if r.Role == "offered" {
+			a.closeOffer(r.StageID, r.TgID, offerWithdrawn)
+		}
+		rep.Cancelled++
+		switch r.Role {
+		case "main":
+			rep.Main++
+		case "reserve":
+			rep.Reserve++
+		case "waitlist":
+			rep.Waitlist++
+		case "offered":
+			rep.Offered++
+		}
+		if !seen[r.TgID] {
+			seen[r.TgID] = true
+			rep.Notify = append(rep.Notify, r.TgID)
+		}
+	}
+	return rep, nil
+}
+
+// add counts the registrations of o as well.
+func (rep *stageCancelReport) add(o stageCancelReport) {
+	rep.Cancelled += o.Cancelled
+	rep.Main += o.Main
+	rep.Reserve += o.Reserve
+	rep.Waitlist += o.Waitlist
+	rep.Offered += o.Offered
+	rep.Paid += o.Paid
+	rep.Refunded += o.Refunded
+	rep.Failed = append(rep.Failed, o.Failed...)
+	seen := map[int64]bool{}
+	for _, id := range rep.Notify {
+		seen[id] = true
+	}
+	for _, id := range o.Notify {
+		if !seen[id] {
+			seen[id] = true
+			rep.Notify = append(rep.Notify, id)
+		}
+	}
+}
+
+// requestRefund asks the provider to return the stage price to the pilot and
+// returns the refund state to save.
+func (a *App) requestRefund(ctx context.Context, s models.Stage, r models.Registration) string {
+	id, err := a.pay.Refund(ctx, s.StageID, r.TgID, s.Price)
+	if err != nil {
+		log.Printf("refund stage %s, pilot %d: %v", s.StageID, r.TgID, err)
+		return refundFailed
+	}
+	log.Printf("refund stage %s, pilot %d: requested %s", s.StageID, r.TgID, id)
+	return refundRequested
+}
+
+func (a *App) stageCancelSummary(ctx context.Context, s models.Stage, reason string, rep stageCancelReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "❌ Этап «%s» отменён.\nПричина: %s\n\n", s.Title, reason)
+	fmt.Fprintf(&b, "Записей отменено: %d (основных: %d, резерв: %d", rep.Cancelled, rep.Main, rep.Reserve)
+	if rep.Waitlist+rep.Offered > 0 {
+		fmt.Fprintf(&b, ", лист ожидания: %d, из них с предложенным местом: %d", rep.Waitlist+rep.Offered, rep.Offered)
+	}
+	b.WriteString(")\n")
+	fmt.Fprintf(&b, "Оплаченных: %d, возврат запрошен: %d", rep.Paid, rep.Refunded)
+	if len(rep.Failed) > 0 {
+		fmt.Fprintf(&b, "\n\n⚠️ Возврат не удался (%d), верни вручную:", len(rep.Failed))
+		for _, r := range rep.Failed {
+			fmt.Fprintf(&b, "\n• %s", a.pilotLabel(ctx, r.TgID))
+		}
+	}
+	if len(rep.Notify) > 0 {
+		b.WriteString("\n\nУведомления пилотам отправляются, прогресс — ниже.")
+	}
+	return b.String()
+}
+
+// pilotLabel names a pilot for admin reports; the tg_id is always there.
+func (a *App) pilotLabel(ctx context.Context, tgID int64) string {
+	p, err := a.db.GetParticipant(ctx, tgID)
+	if err != nil || p == nil {
+		return fmt.Sprint(tgID)
+	}
+	name := strings.TrimSpace(p.FirstName + " " + p.LastName)
+	if p.Nick != "" {
+		name += " (" + p.Nick + ")"
+	}
+	return fmt.Sprintf("%s, tg_id %d", name, tgID)
+}
@@ -0,0 +1,74 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"karting-bot/internal/models"
+	"karting-bot/internal/payments/stub"
+	"karting-bot/internal/store/memory"
+)
+
+// failingRefunds refuses every refund of pilot 2.
+type failingRefunds struct{ *stub.Provider }
+
+func (f failingRefunds) Refund(ctx context.Context, stageID string, tgID int64, amount string) (string, error) {
+	if tgID == 2 {
+		return "", errors.New("provider is down")
+	}
+	return f.Provider.Refund(ctx, stageID, tgID, amount)
+}
+
+func TestCancelStageRegistrations(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	s := models.Stage{StageID: "s1", Title: "Этап 1", Price: "1500", Status: models.StageRegOpen}
+	regs := []models.Registration{
+		{StageID: "s1", TgID: 1, Role: "main", PayStatus: "paid"},
+		{StageID: "s1", TgID: 2, Role: "main", PayStatus: "paid"},
+		{StageID: "s1", TgID: 3, Role: "reserve", PayStatus: "unpaid"},
+		{StageID: "s1", TgID: 4, Role: "main", PayStatus: "cancelled"},
+		{StageID: "s1", TgID: 5, Role: "waitlist", PayStatus: "unpaid"},
+	}
+	for _, r := range regs {
+		if err := db.CreateRegistration(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &App{db: db, pay: failingRefunds{stub.New("secret", "")}}
+
+	rep, err := a.cancelStageRegistrations(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Cancelled != 4 || rep.Main != 2 || rep.Reserve != 1 || rep.Waitlist != 1 || rep.Paid != 2 || rep.Refunded != 1 {
+		t.Errorf("report = %+v", rep)
+	}
+	if len(rep.Failed) != 1 || rep.Failed[0].TgID != 2 {
+		t.Errorf("failed refunds = %+v, want pilot 2", rep.Failed)
+	}
+	if len(rep.Notify) != 4 {
+		t.Errorf("notify = %v, want the 4 active pilots", rep.Notify)
+	}
+
+	got, _ := db.ListRegistrationsForStage(ctx, "s1")
+	want := map[int64]string{1: refundRequested, 2: refundFailed, 3: "", 4: "", 5: ""}
+	for _, r := range got {
+		if r.PayStatus != "cancelled" {
+			t.Errorf("pilot %d: pay_status = %q, want cancelled", r.TgID, r.PayStatus)
+		}
+		if r.Refund != want[r.TgID] {
+			t.Errorf("pilot %d: refund = %q, want %q", r.TgID, r.Refund, want[r.TgID])
+		}
+	}
+
+	// cancelling again finds nothing left to do
+	rep, err = a.cancelStageRegistrations(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Cancelled != 0 || rep.Paid != 0 {
+		t.Errorf("second run report = %+v", rep)
+	}
+}
@@ -0,0 +1,263 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+)
+
+// stageField is a field of models.Stage the admin can edit from the bot.
+type stageField struct {
+	key    string
+	title  string
+	prompt string
+	get    func(s models.Stage) string
+	set    func(s *models.Stage, v string)
+	// validate normalizes the new value like the create flow does
+	validate func(v string) (string, error)
+	// notify tells that registered pilots should hear about the change
+	notify bool
+}
+
+// stageFields are in the order of the create flow. stage_id is not here:
+// registrations and results refer to it.
+var stageFields = []stageField{
+	{key: "title", title: "Название", prompt: "Новое название:",
+		get: func(s models.Stage) string { return s.Title },
+		set: func(s *models.Stage, v string) { s.Title = v }},
+	{key: "date", title: "Дата", prompt: "Новая дата (например 2026-03-10 или 10.03.2026):",
+		get: func(s models.Stage) string { return s.Date }, set: func(s *models.Stage, v string) { s.Date = v },
+		validate: validateStageDate, notify: true},
+	{key: "time", title: "Время", prompt: "Новое время начала (например 18:00):",
+		get: func(s models.Stage) string { return s.Time }, set: func(s *models.Stage, v string) { s.Time = v },
+		validate: validateStageClock, notify: true},
+	{key: "place", title: "Место", prompt: "Новое место:",
+		get: func(s models.Stage) string { return s.Place }, set: func(s *models.Stage, v string) { s.Place = v },
+		notify: true},
+	{key: "address", title: "Адрес", prompt: "Новый адрес:",
+		get: func(s models.Stage) string { return s.Address }, set: func(s *models.Stage, v string) { s.Address = v },
+		notify: true},
+	{key: "price", title: "Цена", prompt: "Новая цена (число, например 1500):",
+		get: func(s models.Stage) string { return s.Price }, set: func(s *models.Stage, v string) { s.Price = v }},
+	{key: "capacity", title: "Мест (карт)", prompt: "Сколько карт (всего мест для основных пилотов)? 0 — без ограничения:",
+		get: func(s models.Stage) string { return s.Capacity }, set: func(s *models.Stage, v string) { s.Capacity = v },
+		validate: validateCapacity},
+	{key: "team_limit", title: "Основных от команды", prompt: "Сколько основных пилотов от одной команды? «-» — по умолчанию:",
+		get: func(s models.Stage) string { return s.TeamLimit }, set: func(s *models.Stage, v string) { s.TeamLimit = v },
+		validate: validateTeamLimit},
+	{key: "pay_deadline", title: "Срок оплаты", prompt: "Срок оплаты: «48h» — через 48 часов после записи, «-3d» — за 3 дня до этапа, «48h,-3d» — что раньше, «0» — без срока, «-» — по умолчанию:",
+		get: func(s models.Stage) string { return s.PayDeadline }, set: func(s *models.Stage, v string) { s.PayDeadline = v },
+		validate: validatePayDeadline},
+}
+
+func findStageField(key string) (stageField, bool) {
+	for _, f := range stageFields {
+		if f.key == key {
+			return f, true
+		}
+	}
+	return stageField{}, false
+}
+
+// startStageEdit starts the admin_edit_stage flow for a stage from the stage list.
+func (a *App) startStageEdit(ctx context.Context, tgID int64, stageID string) error {
+	s, err := a.db.GetStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return a.SendText(tgID, "Этап не найден.")
+	}
+	return a.startFlow(ctx, tgID, "admin_edit_stage", map[string]string{"stage_id": stageID})
+}
+
+func (a *App) askStageField(ctx context.Context, tgID int64, st UserState) error {
+	s, err := a.db.GetStage(ctx, st.Data["stage_id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		a.state.set(tgID, UserState{})
+		return a.SendText(tgID, "Этап не найден. /admin")
+	}
+	text := fmt.Sprintf("✏️ Этап «%s» (id: %s). Что изменить?\n", s.Title, s.StageID)
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, f := range stageFields {
+		text += fmt.Sprintf("\n%s: %s", f.title, f.get(*s))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(f.title, "a:se_field:"+f.key),
+		))
+	}
+	rows = append(rows, flowNavRow(st))
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+func (a *App) askStageValue(ctx context.Context, tgID int64, st UserState) error {
+	f, ok := findStageField(st.Data["field"])
+	if !ok {
+		return fmt.Errorf("edit stage: unknown field %q", st.Data["field"])
+	}
+	msg := tgbotapi.NewMessage(tgID, f.prompt+"\n\nСейчас: "+st.Data["old"])
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(flowNavRow(st))
+	_, err := a.bot.Send(msg)
+	return err
+}
+
+func (a *App) askStageNotify(ctx context.Context, tgID int64, st UserState) error {
+	msg := tgbotapi.NewMessage(tgID, fmt.Sprintf("Сообщить об изменении записанным пилотам (%s)?", st.Data["registered"]))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("📣 Да, сообщить", "a:se_notify:yes"),
+		tgbotapi.NewInlineKeyboardButtonData("Не надо", "a:se_notify:no"),
+	))
+	_, err := a.bot.Send(msg)
+	return err
+}
+
+func (a *App) handleStageEditField(ctx context.Context, tgID int64, key string) error {
+	f, ok := findStageField(key)
+	if !ok {
+		return nil
+	}
+	st, ok := a.flowAt(tgID, "admin_edit_stage", "field")
+	if !ok {
+		return a.SendText(tgID, "Этот шаг уже неактуален. /admin")
+	}
+	s, err := a.db.GetStage(ctx, st.Data["stage_id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		a.state.set(tgID, UserState{})
+		return a.SendText(tgID, "Этап не найден. /admin")
+	}
+	st.Data["field"] = f.key
+	st.Data["old"] = f.get(*s)
+	st.Step++
+	return a.nextStep(ctx, tgID, st)
+}
+
+func (a *App) handleAdminEditStageFlow(ctx context.Context, tgID int64, txt string, st UserState) error {
+	if flowSteps[st.Flow][st.Step-1].key != "value" {
+		// the field and the notification are picked with buttons
+		return a.askStep(ctx, tgID, st)
+	}
+	f, ok := findStageField(st.Data["field"])
+	if !ok {
+		return fmt.Errorf("edit stage: unknown field %q", st.Data["field"])
+	}
+	v := strings.TrimSpace(txt)
+	if v == "" {
+		return a.SendText(tgID, "Пустое значение. Введи ещё раз:")
+	}
+	if f.validate != nil {
+		var err error
+		if v, err = f.validate(v); err != nil {
+			return a.SendText(tgID, "⚠️ "+err.Error()+"\nВведи ещё раз:")
+		}
+	}
+
+	s, err := a.db.GetStage(ctx, st.Data["stage_id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		a.state.set(tgID, UserState{})
+		return a.SendText(tgID, "Этап не найден. /admin")
+	}
+	before := *s
+	f.set(s, v)
+	if f.key == "date" || f.key == "time" {
+		// like in the create flow, a stage can't be moved to the past
+		if start, ok := s.StartsAt(a.cfg.TimeZone); ok && start.Before(time.Now()) {
+			return a.SendText(tgID, "⚠️ "+formatWhen(start, a.cfg.TimeZone)+" уже прошло. Введи ещё раз:")
+		}
+	}
+	if err := a.db.UpdateStage(ctx, *s); err != nil {
+		return err
+	}
+	if err := a.SendText(tgID, fmt.Sprintf("✅ %s: %s → %s", f.title, f.get(before), v)); err != nil {
+		return err
+	}
+	if (f.key == "capacity" || f.key == "team_limit") && f.get(before) != v {
+		// more places may be free now: reserves of the teams first
+		if err := a.promoteReserves(ctx, *s); err != nil {
+			return err
+		}
+		if err := a.offerFreePlaces(ctx, *s); err != nil {
+			return err
+		}
+	}
+
+	if !f.notify || f.get(before) == v {
+		a.state.set(tgID, UserState{})
+		return a.showAdminMenu(tgID)
+	}
+	ids, err := a.broadcastRecipients(ctx, map[string]string{"audience": audienceStage, "target": s.StageID})
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		a.state.set(tgID, UserState{})
+		return a.showAdminMenu(tgID)
+	}
+	st.Data["value"] = v
+	st.Data["registered"] = fmt.Sprint(len(ids))
+	st.Data["notice"] = a.stageChangeNotice(before, *s)
+	st.Step++
+	return a.nextStep(ctx, tgID, st)
+}
+
+func (a *App) handleStageEditNotify(ctx context.Context, tgID int64, answer string) error {
+	st, ok := a.flowAt(tgID, "admin_edit_stage", "notify")
+	if !ok {
+		return a.SendText(tgID, "Этот шаг уже неактуален. /admin")
+	}
+	a.state.set(tgID, UserState{})
+	if answer != "yes" {
+		return a.showAdminMenu(tgID)
+	}
+	return a.launchBroadcast(ctx, tgID, map[string]string{
+		"audience": audienceStage,
+		"target":   st.Data["stage_id"],
+		"text":     st.Data["notice"],
+	})
+}
+
+// stageChangeNotice tells pilots what changed between before and after.
+func (a *App) stageChangeNotice(before, after models.Stage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "📣 Изменения по этапу «%s»:\n", after.Title)
+	if a.stageWhen(before) != a.stageWhen(after) {
+		fmt.Fprintf(&b, "\n📅 Было: %s\n📅 Стало: %s\n", a.stageWhen(before), a.stageWhen(after))
+	}
+	if before.Place != after.Place || before.Address != after.Address {
+		fmt.Fprintf(&b, "\n📍 Было: %s\n📍 Стало: %s\n", orDash(joinPlace(before)), orDash(joinPlace(after)))
+	}
+	return b.String()
+}
+
+// joinPlace is the place and the address of s, either may be empty.
+func joinPlace(s models.Stage) string {
+	parts := []string{}
+	for _, p := range []string{s.Place, s.Address} {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "—"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package tgbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"karting-bot/internal/config"
+	"karting-bot/internal/models"
+	"karting-bot/internal/store/memory"
+)
+
+func newEditApp(t *testing.T, s models.Stage, regs ...models.Registration) (*App, *fakeTelegram) {
+	t.Helper()
+	ctx := context.Background()
+	db := memory.New()
+	if err := db.CreateStage(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range regs {
+		if err := db.CreateRegistration(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	states, _ := newStateMap(MemoryStateStore{})
+	offers, _ := newOfferLog(MemoryOfferStore{})
+	bot, tg := newTestBot(t)
+	return &App{cfg: config.Config{TeamMainLimit: 1, TimeZone: time.UTC}, db: db, bot: bot, state: states, offers: offers}, tg
+}
+
+func editStage(a *App, stageID, field, old, value string) error {
+	st := UserState{Flow: "admin_edit_stage", Step: 2, Data: map[string]string{"stage_id": stageID, "field": field, "old": old}}
+	a.state.set(100, st)
+	return a.handleAdminEditStageFlow(context.Background(), 100, value, st)
+}
+
+// A raised team limit moves the team's reserve to main.
+func TestRaisedTeamLimitPromotesReserve(t *testing.T) {
+	a, tg := newEditApp(t, models.Stage{StageID: "s1", Title: "Этап 1", Date: "2099-05-01", Time: "18:00", TeamLimit: "1", Status: models.StageRegOpen},
+		models.Registration{StageID: "s1", TgID: 1, TeamName: "Молния", Role: "main", PayStatus: "unpaid"},
+		models.Registration{StageID: "s1", TgID: 2, TeamName: "Молния", Role: "reserve", PayStatus: "unpaid", CreatedAt: "2026-05-01T10:00:00Z"},
+		models.Registration{StageID: "s1", TgID: 3, TeamName: "Молния", Role: "reserve", PayStatus: "unpaid", CreatedAt: "2026-05-02T10:00:00Z"},
+	)
+	if err := editStage(a, "s1", "team_limit", "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	for id, role := range map[int64]string{2: "main", 3: "reserve"} {
+		if r, _ := a.pilotRegistration(context.Background(), "s1", id); r.Role != role {
+			t.Errorf("pilot %d is %s, want %s", id, r.Role, role)
+		}
+	}
+	if sent := tg.to(2); len(sent) != 1 || !strings.Contains(sent[0], "основной состав") {
+		t.Errorf("pilot 2 was sent %q, want the promotion", sent)
+	}
+}
+
+func TestStageDateEditRejectsPast(t *testing.T) {
+	a, tg := newEditApp(t, models.Stage{StageID: "s1", Title: "Этап 1", Date: "2099-05-01", Time: "18:00", Status: models.StageRegOpen})
+	if err := editStage(a, "s1", "date", "2099-05-01", "01.01.2020"); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := a.db.GetStage(context.Background(), "s1")
+	if s.Date != "2099-05-01" {
+		t.Errorf("date = %s, want it unchanged", s.Date)
+	}
+	if sent := tg.to(100); len(sent) != 1 || !strings.Contains(sent[0], "уже прошло") {
+		t.Errorf("admin was sent %q, want the past date rejected", sent)
+	}
+}
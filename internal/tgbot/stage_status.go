@@ -0,0 +1,133 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"karting-bot/internal/models"
+)
+
+var stageStatusTitles = map[string]string{
+	models.StageDraft:     "📝 Черновик",
+	models.StageRegOpen:   "🟢 Регистрация открыта",
+	models.StageRegClosed: "🔒 Регистрация закрыта",
+	models.StageRunning:   "🏎 Идёт",
+	models.StageFinished:  "🏁 Завершён",
+	models.StageCancelled: "❌ Отменён",
+}
+
+// stageStatusActions are the button titles that move a stage to a status.
+var stageStatusActions = map[string]string{
+	models.StageRegOpen:   "🟢 Открыть регистрацию",
+	models.StageRegClosed: "🔒 Закрыть регистрацию",
+	models.StageRunning:   "🏎 Этап начался",
+	models.StageFinished:  "🏁 Завершить (результаты опубликованы)",
+	models.StageCancelled: "❌ Отменить этап",
+}
+
+func stageStatusTitle(status string) string {
+	if t, ok := stageStatusTitles[status]; ok {
+		return t
+	}
+	return status
+}
+
+// Which stages each screen shows.
+func stageListedForPilots(s models.Stage) bool {
+	return s.Status != models.StageDraft
+}
+
+// stageReminded tells whether registered pilots get reminders about s.
+func stageReminded(s models.Stage) bool {
+	switch s.Status {
+	case models.StageRegOpen, models.StageRegClosed, models.StageRunning:
+		return true
+	}
+	return false
+}
+
+func stageHasResults(s models.Stage) bool {
+	return s.Status == models.StageFinished
+}
+
+func stageHasPhotos(s models.Stage) bool {
+	return s.Status == models.StageRunning || s.Status == models.StageFinished
+}
+
+func filterStages(stages []models.Stage, keep func(models.Stage) bool) []models.Stage {
+	out := stages[:0]
+	for _, s := range stages {
+		if keep(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// showStageStatus shows the status of a stage with the moves allowed from it.
+func (a *App) showStageStatus(ctx context.Context, tgID int64, stageID string) error {
+	s, err := a.db.GetStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return a.SendText(tgID, "Этап не найден.")
+	}
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, next := range models.NextStatuses(s.Status) {
+		if btn, ok := callbackButton(stageStatusActions[next], "a:set_status:"+s.StageID+":"+next); ok {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+		}
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⏳ Лист ожидания", "a:offers:"+s.StageID),
+		tgbotapi.NewInlineKeyboardButtonData("📋 Список этапов", "a:list_stages"),
+	))
+	text := fmt.Sprintf("⚙️ Этап «%s» (id: %s)\nСтатус: %s", s.Title, s.StageID, stageStatusTitle(s.Status))
+	if len(models.NextStatuses(s.Status)) == 0 {
+		text += "\n\nСтатус окончательный, изменить его нельзя."
+	}
+	msg := tgbotapi.NewMessage(tgID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err = a.bot.Send(msg)
+	return err
+}
+
+// setStageStatus moves a stage; arg is "<stage_id>:<status>". Only the moves
+// of models.NextStatuses are allowed, whatever the button says.
+func (a *App) setStageStatus(ctx context.Context, tgID int64, arg string) error {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 {
+		return nil
+	}
+	stageID, to := arg[:i], arg[i+1:]
+	s, err := a.db.GetStage(ctx, stageID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return a.SendText(tgID, "Этап не найден.")
+	}
+	if !models.CanMoveStage(s.Status, to) {
+		if err := a.SendText(tgID, fmt.Sprintf("⚠️ Из статуса «%s» в «%s» перейти нельзя.", stageStatusTitle(s.Status), stageStatusTitle(to))); err != nil {
+			return err
+		}
+		return a.showStageStatus(ctx, tgID, stageID)
+	}
+	if to == models.StageCancelled {
+		// registrants have to be told why, and paid entries refunded
+		return a.startFlow(ctx, tgID, "admin_cancel_stage", map[string]string{"stage_id": stageID})
+	}
+	from := s.Status
+	s.SetStatus(to)
+	if err := a.db.UpdateStage(ctx, *s); err != nil {
+		return err
+	}
+	if err := a.SendText(tgID, fmt.Sprintf("✅ «%s»: %s → %s", s.Title, stageStatusTitle(from), stageStatusTitle(to))); err != nil {
+		return err
+	}
+	return a.showStageStatus(ctx, tgID, stageID)
+}
@@ -0,0 +1,30 @@
+package tgbot
+
+import (
+	"testing"
+	"time"
+
+	"karting-bot/internal/models"
+)
+
+func TestSortStagesChronologically(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Moscow")
+	stages := []models.Stage{
+		{StageID: "late", Date: "2026-05-10", Time: "12:00"},
+		{StageID: "free-text", Date: "в мае", Time: ""},
+		{StageID: "early", Date: "10.03.2026", Time: "18:00"},
+		{StageID: "same-day-earlier", Date: "2026-05-10", Time: "9:30"},
+	}
+	sortStages(stages, loc)
+	want := []string{"early", "same-day-earlier", "late", "free-text"}
+	for i, id := range want {
+		if stages[i].StageID != id {
+			t.Fatalf("position %d: got %s, want %s", i, stages[i].StageID, id)
+		}
+	}
+
+	now := time.Date(2026, 4, 1, 0, 0, 0, 0, loc)
+	if !stagePast(stages[0], loc, now) || stagePast(stages[2], loc, now) || stagePast(stages[3], loc, now) {
+		t.Error("wrong past stages")
+	}
+}
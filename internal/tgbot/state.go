@@ -0,0 +1,98 @@
+package tgbot
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"karting-bot/internal/persist"
+)
+
+// UserState is the position of a user in a multi-step flow.
+type UserState struct {
+	Flow      string
+	Step      int
+	Data      map[string]string
+	UpdatedAt time.Time
+}
+
+// StateStore persists conversation state so flows survive restarts.
+type StateStore = persist.Store[map[int64]UserState]
+
+// MemoryStateStore keeps nothing between restarts.
+type MemoryStateStore = persist.Memory[map[int64]UserState]
+
+// stateMap holds conversation state per user. It is shared by all update
+// workers, so every access goes through the mutex. Every change is written
+// to the backing StateStore.
+type stateMap struct {
+	mu    sync.Mutex
+	m     map[int64]UserState
+	store StateStore
+}
+
+func newStateMap(store StateStore) (*stateMap, error) {
+	m, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = map[int64]UserState{}
+	}
+	return &stateMap{m: m, store: store}, nil
+}
+
+// get returns a copy, so callers may change Data without holding the lock.
+func (s *stateMap) get(tgID int64) UserState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.m[tgID]
+	if st.Data != nil {
+		data := make(map[string]string, len(st.Data))
+		for k, v := range st.Data {
+			data[k] = v
+		}
+		st.Data = data
+	}
+	return st
+}
+
+func (s *stateMap) set(tgID int64, st UserState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.Flow == "" {
+		if _, ok := s.m[tgID]; !ok {
+			return
+		}
+		delete(s.m, tgID)
+	} else {
+		st.UpdatedAt = time.Now()
+		s.m[tgID] = st
+	}
+	s.save()
+}
+
+// expire drops states not touched for longer than timeout and returns them.
+func (s *stateMap) expire(timeout time.Duration) map[int64]UserState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := map[int64]UserState{}
+	for id, st := range s.m {
+		if time.Since(st.UpdatedAt) > timeout {
+			expired[id] = st
+			delete(s.m, id)
+		}
+	}
+	if len(expired) > 0 {
+		s.save()
+	}
+	return expired
+}
+
+// save must be called with the lock held. A failed save only costs the
+// state on the next restart, so it is logged and not returned.
+func (s *stateMap) save() {
+	if err := s.store.Save(s.m); err != nil {
+		log.Printf("save state: %v", err)
+	}
+}
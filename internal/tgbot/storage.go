@@ -0,0 +1,101 @@
+package tgbot
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"karting-bot/internal/persist"
+)
+
+// Storage is where the bot keeps its own data between restarts: what is not
+// championship data and so does not belong to the store.Store.
+type Storage struct {
+	States     StateStore
+	Broadcasts BroadcastStore
+	Sent       SentStore
+	Offers     OfferStore
+}
+
+// FileStorage keeps everything in JSON files in dir.
+func FileStorage(dir string) Storage {
+	return Storage{
+		States:     persist.NewFile[map[int64]UserState](filepath.Join(dir, "state.json")),
+		Broadcasts: persist.NewFile[[]BroadcastJob](filepath.Join(dir, "broadcasts.json")),
+		Sent:       persist.NewFile[map[string]time.Time](filepath.Join(dir, "sent.json")),
+		Offers:     persist.NewFile[[]WaitlistOffer](filepath.Join(dir, "offers.json")),
+	}
+}
+
+// MemoryStorage keeps nothing between restarts.
+func MemoryStorage() Storage {
+	return Storage{
+		States:     MemoryStateStore{},
+		Broadcasts: MemoryBroadcastStore{},
+		Sent:       MemorySentStore{},
+		Offers:     MemoryOfferStore{},
+	}
+}
+
+// SentStore persists marks of automatic notifications already sent, so a
+// restart does not send them twice. A mark maps a key to when it was set.
+type SentStore = persist.Store[map[string]time.Time]
+
+// MemorySentStore keeps nothing between restarts.
+type MemorySentStore = persist.Memory[map[string]time.Time]
+
+// sentMarkTTL is how long marks are kept: longer than any reminder offset.
+const sentMarkTTL = 90 * 24 * time.Hour
+
+// sentLog remembers which automatic notifications went out.
+type sentLog struct {
+	mu    sync.Mutex
+	marks map[string]time.Time
+	store SentStore
+}
+
+func newSentLog(store SentStore) (*sentLog, error) {
+	marks, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if marks == nil {
+		marks = map[string]time.Time{}
+	}
+	for k, at := range marks {
+		if time.Since(at) > sentMarkTTL {
+			delete(marks, k)
+		}
+	}
+	return &sentLog{marks: marks, store: store}, nil
+}
+
+func (s *sentLog) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.marks[key]
+	return ok
+}
+
+// at is when key was marked.
+func (s *sentLog) at(key string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.marks[key]
+	return t, ok
+}
+
+// mark sets the marks and saves them. A failed save is logged: the worst
+// case is a repeated notification after a restart.
+func (s *sentLog) mark(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, k := range keys {
+		s.marks[k] = now
+	}
+	if err := s.store.Save(s.marks); err != nil {
+		log.Printf("save sent marks: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package tgbot
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeTelegram answers Bot API calls without the network and keeps the
+// texts sent to each chat. Chats in blocked answer like a user who blocked
+// the bot.
+type fakeTelegram struct {
+	mu      sync.Mutex
+	sent    map[int64][]string
+	blocked map[int64]bool
+}
+
+func newTestBot(t *testing.T) (*tgbotapi.BotAPI, *fakeTelegram) {
+	t.Helper()
+	f := &fakeTelegram{sent: map[int64][]string{}, blocked: map[int64]bool{}}
+	bot, err := tgbotapi.NewBotAPIWithClient("test", "http://telegram.test/bot%s/%s", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, f
+}
+
+func (f *fakeTelegram) Do(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	result := `{"id":1,"is_bot":true,"username":"test_bot"}`
+	if path.Base(req.URL.Path) != "getMe" {
+		chatID, _ := strconv.ParseInt(form.Get("chat_id"), 10, 64)
+		f.mu.Lock()
+		blocked := f.blocked[chatID]
+		if !blocked {
+			f.sent[chatID] = append(f.sent[chatID], form.Get("text"))
+		}
+		f.mu.Unlock()
+		if blocked {
+			return jsonResponse(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`), nil
+		}
+		result = fmt.Sprintf(`{"message_id":1,"date":0,"chat":{"id":%d}}`, chatID)
+	}
+	return jsonResponse(`{"ok":true,"result":` + result + `}`), nil
+}
+
+func jsonResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// to is what chatID was sent.
+func (f *fakeTelegram) to(chatID int64) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent[chatID]...)
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+    "errors"
+    "strings"
+    "time"
+)
+
+const (
+    // DateTimeLayout is how dates with time are shown to admins and typed back.
+    DateTimeLayout = "02.01.2006 15:04"
+    // DateLayout and ClockLayout are how a stage date and time are stored.
+    DateLayout  = "2006-01-02"
+    ClockLayout = "15:04"
+)
+
+var (
+    errDateTime = errors.New("не понял дату и время, нужен формат ДД.ММ.ГГГГ ЧЧ:ММ, например 15.06.2025 10:00")
+    errDate     = errors.New("не понял дату, нужен формат ГГГГ-ММ-ДД или ДД.ММ.ГГГГ, например 2026-03-10")
+    errClock    = errors.New("не понял время, нужен формат ЧЧ:ММ, например 18:00")
+)
+
+// ParseDateTime reads "ДД.ММ.ГГГГ ЧЧ:ММ" in loc. Without the year it is the
+// nearest such moment after now.
+func ParseDateTime(s string, loc *time.Location, now time.Time) (time.Time, error) {
+    s = strings.Join(strings.Fields(s), " ")
+    for _, layout := range []string{"2.1.2006 15:04", "2.1.06 15:04", "2006-01-02 15:04"} {
+        if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+            return t, nil
+        }
+    }
+    t, err := time.ParseInLocation("2.1 15:04", s, loc)
+    if err != nil {
+        return time.Time{}, errDateTime
+    }
+    t = time.Date(now.In(loc).Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+    if t.Before(now) {
+        t = t.AddDate(1, 0, 0)
+    }
+    return t, nil
+}
+
+// ParseDate reads a date as 2026-03-10, 10.03.2026 or 10.03.26.
+func ParseDate(s string) (time.Time, error) {
+    s = strings.TrimSpace(s)
+    for _, layout := range []string{DateLayout, "2.1.2006", "2.1.06", "2006-1-2"} {
+        if t, err := time.Parse(layout, s); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, errDate
+}
+
+// ParseClock reads a time of day as 18:00, 18.00 or 9:30.
+func ParseClock(s string) (time.Time, error) {
+    s = strings.ReplaceAll(strings.TrimSpace(s), ".", ":")
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return time.Time{}, errClock
+    }
+    return t, nil
+}
+
+// CombineDateClock is the moment of a date and a time of day, as read by
+// ParseDate and ParseClock, in loc.
+func CombineDateClock(date, clock string, loc *time.Location) (time.Time, error) {
+    d, err := ParseDate(date)
+    if err != nil {
+        return time.Time{}, err
+    }
+    c, err := ParseClock(clock)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return time.Date(d.Year(), d.Month(), d.Day(), c.Hour(), c.Minute(), 0, 0, loc), nil
+}
@@ -27,3 +27,47 @@ func HMACSHA256Hex(secret, msg string) string {
     mac.Write([]byte(msg))
     return hex.EncodeToString(mac.Sum(nil))
 }
+
+var translitRU = map[rune]string{
+    'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+    'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+    'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+    'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+    'я': "ya",
+}
+
+// Translit converts Russian letters to latin ones; other runes are kept as is.
+func Translit(s string) string {
+    b := strings.Builder{}
+    for _, r := range strings.ToLower(s) {
+        if t, ok := translitRU[r]; ok {
+            b.WriteString(t)
+        } else {
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
+
+// Slug makes a short latin id from s (Cyrillic is transliterated); returns
+// fallback when nothing is left.
+func Slug(s, fallback string) string {
+    const maxLen = 24
+    s = Translit(strings.TrimSpace(s))
+    b := strings.Builder{}
+    for _, r := range s {
+        if b.Len() >= maxLen {
+            break
+        }
+        if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+            b.WriteRune(r)
+        } else if r == ' ' || r == '-' || r == '_' {
+            b.WriteRune('-')
+        }
+    }
+    out := strings.Trim(b.String(), "-")
+    if out == "" {
+        out = fallback
+    }
+    return out
+}